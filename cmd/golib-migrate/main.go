@@ -0,0 +1,30 @@
+// Command golib-migrate runs the migrations of the go-lib packages: process, pubsub,
+// sync, algolia and arc. The database connection is read from the environment, see
+// sql.GetConnParamFromENV. Run it without arguments for usage. Applications with their
+// own migration lists can build a similar command with migration/cli.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Skyrin/go-lib/algolia"
+	"github.com/Skyrin/go-lib/arc"
+	"github.com/Skyrin/go-lib/migration/cli"
+	"github.com/Skyrin/go-lib/process"
+	"github.com/Skyrin/go-lib/pubsub"
+	"github.com/Skyrin/go-lib/sync"
+)
+
+func main() {
+	if err := cli.Run(os.Args[1:],
+		process.GetMigrationList(),
+		pubsub.GetMigrationList(),
+		sync.GetMigrationList(),
+		algolia.GetMigrationList(),
+		arc.GetMigrationList(),
+	); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
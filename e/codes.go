@@ -18,11 +18,24 @@ const (
 	Code0001 = "0001" // package:migration | migration/migration.go
 	Code0002 = "0002" // package:migration | migration/migration_list.go
 	Code0003 = "0003" // package:migration/sqlmodel | migration/sqlmodel/migration.go
+	Code0004 = "0004" // package:migration | migration/lock.go
+	Code0005 = "0005" // package:migration | migration/verify.go
+	Code0006 = "0006" // package:migration | migration/status.go
+	Code0007 = "0007" // package:migration/cli | migration/cli/cli.go
+	Code0008 = "0008" // package:migration | migration/depend.go
+	Code0009 = "0009" // package:migration | migration/history.go
+	Code000A = "000A" // package:migration | migration/safety.go
 
 	// package: migrationpgx
 	Code0101 = "0101" // package:migrationpgx | migration/migration.go
 	Code0102 = "0102" // package:migrationpgx | migration/migration_list.go
 	Code0103 = "0103" // package:migrationpgx/sqlmodel | migration/sqlmodel/migration.go
+	Code0104 = "0104" // package:migrationpgx | migrationpgx/lock.go
+	Code0105 = "0105" // package:migrationpgx | migrationpgx/verify.go
+	Code0106 = "0106" // package:migrationpgx | migrationpgx/status.go
+	Code0107 = "0107" // package:migrationpgx | migrationpgx/depend.go
+	Code0108 = "0108" // package:migrationpgx | migrationpgx/history.go
+	Code0109 = "0109" // package:migrationpgx | migrationpgx/safety.go
 
 	// package: sql
 	Code0201 = "0201" // package:sql | sql/count.go
@@ -34,12 +47,21 @@ const (
 	Code0207 = "0207" // package:sql | sql/bulk.go
 	Code0208 = "0208" // package:sql | sql/statement.go
 	Code0209 = "0209" // package:sql | sql/bulk_update.go
+	Code020A = "020A" // package:sql | sql/jsonb.go
+	Code020B = "020B" // package:sql | sql/connect.go
 
 	// package: process
 	Code0301 = "0301" // package:process | process/process.go
 	Code0302 = "0302" // package:sqlmodel | process/internal/sqlmodel/process.go
 	Code0303 = "0303" // package:sqlmodel | process/internal/sqlmodel/process_run.go
 	Code0304 = "0304" // package:process | process/queue.go
+	Code0305 = "0305" // package:process | process/scheduler.go
+	Code0306 = "0306" // package:process | process/schedule.go
+	Code0307 = "0307" // package:process | process/lease.go
+	Code0308 = "0308" // package:process | process/retry.go
+	Code0309 = "0309" // package:process | process/dependency.go
+	Code030A = "030A" // package:process | process/request.go
+	Code030B = "030B" // package:sqlmodel | process/internal/sqlmodel/process_request.go
 
 	//package: arc
 	Code0401 = "0401" // package:arc | arc/arc_client.go
@@ -117,10 +139,25 @@ const (
 	Code0907 = "0907" // package:sqlpgx | sqlpgx/bulk.go
 	Code0908 = "0908" // package:sqlpgx | sqlpgx/statement.go
 	Code0909 = "0909" // package:sqlpgx | sqlpgx/bulk_update.go
+	Code090A = "090A" // package:sqlpgx | sqlpgx/jsonb.go
+	Code090B = "090B" // package:sqlpgx | sqlpgx/connect.go
+	Code090C = "090C" // package:sqlpgx | sqlpgx/pool.go
+	Code090D = "090D" // package:sqlpgx | sqlpgx/batch.go
+	Code090E = "090E" // package:sqlpgx | sqlpgx/types.go
 
 	// package: processpgx
 	Code0A01 = "0A01" // package:processpgx | processpgx/process.go
 	Code0A02 = "0A02" // package:sqlmodel | processpgx/internal/sqlmodel/process.go
 	Code0A03 = "0A03" // package:sqlmodel | processpgx/internal/sqlmodel/process_run.go
 	Code0A04 = "0A04" // package:processpgx | processpgx/queue.go
+	Code0A05 = "0A05" // package:processpgx | processpgx/scheduler.go
+	Code0A06 = "0A06" // package:processpgx | processpgx/schedule.go
+	Code0A07 = "0A07" // package:processpgx | processpgx/lease.go
+	Code0A08 = "0A08" // package:processpgx | processpgx/retry.go
+	Code0A09 = "0A09" // package:processpgx | processpgx/dependency.go
+	Code0A0A = "0A0A" // package:processpgx | processpgx/request.go
+	Code0A0B = "0A0B" // package:sqlmodel | processpgx/internal/sqlmodel/process_request.go
+
+	// package: processutil
+	Code0B01 = "0B01" // package:processutil | internal/processutil/schedule.go
 )
@@ -16,6 +16,18 @@ const (
 	MsgMigrationFileNameInvalid        = "Invalid migration file name"
 	MsgMigrationFileNameVersionInvalid = "Invalid migration file name version"
 	MsgMigrationInstallFailed          = "Migrator installation failed"
+	MsgMigrationDownWithoutUp          = "Down migration file without up migration file"
+	MsgMigrationDownMissing            = "Migration version has no down migration"
+	MsgMigrationListNotFound           = "Migration list not added to the migrator"
+	MsgMigrationVersionNotFound        = "Migration version does not exist"
+	MsgMigrationLocked                 = "Migration lock held by another instance"
+	MsgMigrationDrift                  = "Migration files differ from the applied migrations"
+	MsgMigrationVersionDuplicate       = "Migration version used more than once"
+	MsgMigrationVersionGap             = "Migration versions are not incremental"
+	MsgMigrationListInvalid            = "Invalid migration list"
+	MsgMigrationDependencyCycle        = "Migration list dependency cycle"
+	MsgMigrationDependencyUnmet        = "Migration list dependency not met"
+	MsgMigrationUnsafe                 = "Migration SQL takes long locks on existing tables"
 
 	// arc
 	MsgCartCustomerExists     = "Cart customer already exist"
@@ -0,0 +1,58 @@
+package processutil
+
+import (
+	"sort"
+)
+
+// IsUpstream checks if the upstream code is upstream of the code, directly or not, in the
+// map of the upstream codes of each code
+func IsUpstream(upstreamMap map[string][]string, upstreamCode, code string) bool {
+	for _, c := range upstreamMap[code] {
+		if c == upstreamCode || IsUpstream(upstreamMap, upstreamCode, c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetDownstreamList returns the codes downstream of the code, directly or not, in the map
+// of the upstream codes of each code. Each code is after all of its upstream codes, codes
+// that do not depend on each other are sorted.
+func GetDownstreamList(upstreamMap map[string][]string, code string) (codeList []string) {
+	// Sort the codes so processes that do not depend on each other run in a stable order
+	allCodeList := make([]string, 0, len(upstreamMap))
+	for c := range upstreamMap {
+		allCodeList = append(allCodeList, c)
+	}
+	sort.Strings(allCodeList)
+
+	doneMap := map[string]bool{code: true}
+	for {
+		added := false
+		for _, c := range allCodeList {
+			if doneMap[c] || !IsUpstream(upstreamMap, code, c) {
+				continue
+			}
+
+			// Add it once all of its upstream codes downstream of the code are added
+			ready := true
+			for _, upstreamCode := range upstreamMap[c] {
+				if !doneMap[upstreamCode] && IsUpstream(upstreamMap, code, upstreamCode) {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				doneMap[c] = true
+				codeList = append(codeList, c)
+				added = true
+			}
+		}
+
+		if !added {
+			return codeList
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package processutil
+
+import (
+	"slices"
+	"testing"
+)
+
+// testUpstreamMap extract runs first, then transform and enrich, which load waits for.
+// Report only depends on transform, audit is unrelated.
+var testUpstreamMap = map[string][]string{
+	"transform": {"extract"},
+	"enrich":    {"extract"},
+	"load":      {"transform", "enrich"},
+	"report":    {"transform"},
+	"audit":     {"archive"},
+}
+
+func TestIsUpstream(t *testing.T) {
+	tests := []struct {
+		upstreamCode string
+		code         string
+		want         bool
+	}{
+		{"extract", "transform", true},
+		{"extract", "load", true},
+		{"enrich", "load", true},
+		{"extract", "report", true},
+		{"enrich", "report", false},
+		{"load", "extract", false},
+		{"extract", "extract", false},
+		{"extract", "audit", false},
+		{"extract", "unknown", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsUpstream(testUpstreamMap, tt.upstreamCode, tt.code); got != tt.want {
+			t.Errorf("IsUpstream(%s, %s) = %t, want %t", tt.upstreamCode, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestIsUpstreamCycle(t *testing.T) {
+	// Setting load as upstream of extract would add a cycle, as extract is upstream of load
+	if !IsUpstream(testUpstreamMap, "extract", "load") {
+		t.Error("IsUpstream(extract, load) = false, want the cycle to be detected")
+	}
+
+	// Setting report as upstream of audit does not
+	if IsUpstream(testUpstreamMap, "audit", "report") {
+		t.Error("IsUpstream(audit, report) = true, want no cycle")
+	}
+}
+
+func TestGetDownstreamList(t *testing.T) {
+	tests := []struct {
+		code string
+		want []string
+	}{
+		{"extract", []string{"enrich", "transform", "load", "report"}},
+		{"transform", []string{"load", "report"}},
+		{"enrich", []string{"load"}},
+		{"load", nil},
+		{"archive", []string{"audit"}},
+		{"unknown", nil},
+	}
+
+	for _, tt := range tests {
+		if got := GetDownstreamList(testUpstreamMap, tt.code); !slices.Equal(got, tt.want) {
+			t.Errorf("GetDownstreamList(%s) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
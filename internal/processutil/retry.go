@@ -0,0 +1,28 @@
+package processutil
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// GetRetryDelay returns the delay before the attempt (starting at 1) of a retry policy.
+// The backoff is doubled for every attempt after the first and limited to the max backoff,
+// if set, then up to the jitter fraction of it is randomly added or removed.
+func GetRetryDelay(backoff, maxBackoff time.Duration, jitter float64,
+	attempt int) (delay time.Duration) {
+	delay = backoff
+	for i := 1; i < attempt && delay < math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+
+	if maxBackoff > 0 && delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	if jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * jitter * float64(delay))
+	}
+
+	return delay
+}
@@ -0,0 +1,42 @@
+package processutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetRetryDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		backoff    time.Duration
+		maxBackoff time.Duration
+		attempt    int
+		want       time.Duration
+	}{
+		{"first attempt", time.Second, 0, 1, time.Second},
+		{"second attempt", time.Second, 0, 2, 2 * time.Second},
+		{"fourth attempt", time.Second, 0, 4, 8 * time.Second},
+		{"max backoff", time.Second, 5 * time.Second, 4, 5 * time.Second},
+		{"below max backoff", time.Second, 5 * time.Second, 3, 4 * time.Second},
+		{"overflow", time.Hour, 0, 100, time.Hour << 21},
+		{"overflow max backoff", time.Hour, 24 * time.Hour, 100, 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := GetRetryDelay(tt.backoff, tt.maxBackoff, 0, tt.attempt)
+			if got != tt.want {
+				t.Errorf("GetRetryDelay() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRetryDelayJitter(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		got := GetRetryDelay(10*time.Second, 0, 0.2, 1)
+		if got < 8*time.Second || got > 12*time.Second {
+			t.Fatalf("GetRetryDelay() = %s, want between 8s and 12s", got)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+// Package processutil holds the logic of the process and processpgx packages that does not
+// depend on the DB driver, so the two packages share it instead of keeping copies in sync.
+package processutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+)
+
+const (
+	// scheduleYearLimit how many years ahead Next looks for a run time before giving up,
+	// e.g. for 0 0 29 2 MON, which only matches every few years
+	scheduleYearLimit = 5
+	// scheduleBlackoutLimit how many run times in a blackout Next skips before giving up,
+	// e.g. if the blackouts cover every run time
+	scheduleBlackoutLimit = 1000
+
+	ECode0B0101 = e.Code0B01 + "01"
+	ECode0B0102 = e.Code0B01 + "02"
+	ECode0B0103 = e.Code0B01 + "03"
+	ECode0B0104 = e.Code0B01 + "04"
+	ECode0B0105 = e.Code0B01 + "05"
+	ECode0B0106 = e.Code0B01 + "06"
+	ECode0B0107 = e.Code0B01 + "07"
+	ECode0B0108 = e.Code0B01 + "08"
+	ECode0B0109 = e.Code0B01 + "09"
+	ECode0B010A = e.Code0B01 + "0A"
+	ECode0B010B = e.Code0B01 + "0B"
+	ECode0B010C = e.Code0B01 + "0C"
+	ECode0B010D = e.Code0B01 + "0D"
+	ECode0B010E = e.Code0B01 + "0E"
+)
+
+var (
+	// scheduleMacroMap the supported macros and the expressions they stand for
+	scheduleMacroMap = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+
+	// monthDayList the most days in each month, including leap years
+	monthDayList = []int{31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+	monthNameList   = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	weekdayNameList = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+)
+
+// Schedule a cron schedule in a time zone. The expression has 5 fields, minute hour
+// day-of-month month day-of-week, or 6 fields with a leading second field. Each field
+// is *, a value, a range (1-5), a step (*/15, 0-30/10) or a list of them (1,15,30).
+// Months and weekdays can also be names (JAN, MON), 7 is also Sunday and ? is the same
+// as *. If both the day of month and the day of week are restricted, either can match,
+// as in standard cron. The macros @yearly, @monthly, @weekly, @daily and @hourly are
+// also supported.
+//
+// Run times are wall clock times in the time zone. A run time skipped by a daylight saving
+// time change (e.g. 2:30 when clocks go from 2:00 to 3:00) runs at the end of the change
+// (3:00), a run time repeated by a change (e.g. 1:30 when clocks go from 2:00 back to 1:00)
+// only runs the first time.
+//
+//	0 2 * * *        2am daily
+//	0 9 * * MON-FRI  every weekday at 9:00
+//	*/30 * * * * *   every 30 seconds
+type Schedule struct {
+	expr         string
+	loc          *time.Location
+	second       uint64
+	minute       uint64
+	hour         uint64
+	dom          uint64
+	month        uint64
+	dow          uint64
+	domStar      bool // Day of month is unrestricted
+	dowStar      bool // Day of week is unrestricted
+	blackoutList []*Blackout
+}
+
+// Blackout a window in which a scheduled process does not run, e.g. a nightly
+// maintenance window. Start and End are times of day, HH:MM, in the schedule's time zone,
+// the window includes Start but not End and wraps midnight if End is before Start. If
+// Weekdays is set, the window only starts on those days.
+type Blackout struct {
+	Start    string
+	End      string
+	Weekdays []time.Weekday
+	start    int // Minute of the day
+	end      int // Minute of the day
+}
+
+// scheduleField the valid range and names of a field
+type scheduleField struct {
+	name     string
+	min      int
+	max      int
+	nameList []string // Names of the values, starting at min
+}
+
+// ParseSchedule parses the cron expression in the time zone, an IANA name such as
+// America/Chicago. If the time zone is empty, UTC is used.
+func ParseSchedule(expr, tz string) (s *Schedule, err error) {
+	loc := time.UTC
+	if tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return nil, e.W(err, ECode0B0101, fmt.Sprintf("tz: %s", tz))
+		}
+	}
+
+	s = &Schedule{
+		expr: expr,
+		loc:  loc,
+	}
+
+	fieldList := strings.Fields(expr)
+	if len(fieldList) == 1 && strings.HasPrefix(fieldList[0], "@") {
+		macro, ok := scheduleMacroMap[strings.ToLower(fieldList[0])]
+		if !ok {
+			return nil, e.N(ECode0B0102, fmt.Sprintf("unknown schedule macro: %s", expr))
+		}
+		fieldList = strings.Fields(macro)
+	}
+
+	switch len(fieldList) {
+	case 5:
+		fieldList = append([]string{"0"}, fieldList...)
+	case 6:
+	default:
+		return nil, e.N(ECode0B0103,
+			fmt.Sprintf("schedule must have 5 or 6 fields, got %d: %s", len(fieldList), expr))
+	}
+
+	for i, sf := range []*scheduleField{
+		{name: "second", min: 0, max: 59},
+		{name: "minute", min: 0, max: 59},
+		{name: "hour", min: 0, max: 23},
+		{name: "day of month", min: 1, max: 31},
+		{name: "month", min: 1, max: 12, nameList: monthNameList},
+		{name: "day of week", min: 0, max: 7, nameList: weekdayNameList},
+	} {
+		bits, err := sf.parse(fieldList[i])
+		if err != nil {
+			return nil, e.W(err, ECode0B0104, expr)
+		}
+
+		switch i {
+		case 0:
+			s.second = bits
+		case 1:
+			s.minute = bits
+		case 2:
+			s.hour = bits
+		case 3:
+			s.dom = bits
+			s.domStar = isStar(fieldList[i])
+		case 4:
+			s.month = bits
+		case 5:
+			// 7 is also Sunday
+			if bits&(1<<7) != 0 {
+				bits |= 1
+			}
+			s.dow = bits
+			s.dowStar = isStar(fieldList[i])
+		}
+	}
+
+	if !s.hasDay() {
+		return nil, e.N(ECode0B010E, fmt.Sprintf("schedule never runs: %s", expr))
+	}
+
+	return s, nil
+}
+
+// String returns the cron expression
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// Location returns the time zone of the schedule
+func (s *Schedule) Location() *time.Location {
+	return s.loc
+}
+
+// AddBlackout adds a window in which the schedule does not run. A run time in the window
+// is skipped, the next run time after it is used instead.
+func (s *Schedule) AddBlackout(b *Blackout) (err error) {
+	if b.start, err = parseTimeOfDay(b.Start); err != nil {
+		return e.W(err, ECode0B0105)
+	}
+
+	if b.end, err = parseTimeOfDay(b.End); err != nil {
+		return e.W(err, ECode0B0106)
+	}
+
+	if b.start == b.end {
+		return e.N(ECode0B0107, fmt.Sprintf("blackout start and end are the same: %s", b.Start))
+	}
+
+	s.blackoutList = append(s.blackoutList, b)
+
+	return nil
+}
+
+// Next returns the first run time after t, in the schedule's time zone, that is not in a
+// blackout. Returns the zero time if there is none within the next few years, e.g. if the
+// blackouts cover every run time.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc).Truncate(time.Second).Add(time.Second)
+
+	for i := 0; i < scheduleBlackoutLimit; i++ {
+		t = s.match(t)
+		if t.IsZero() {
+			return t
+		}
+
+		b := s.getBlackout(t)
+		if b == nil {
+			return t
+		}
+		t = b.getEnd(t)
+	}
+
+	return time.Time{}
+}
+
+// match returns the first run time at or after t, or the zero time if there is none
+// within the year limit. The fields are matched against the wall clock in the schedule's
+// time zone, see getTime.
+func (s *Schedule) match(t time.Time) time.Time {
+	w := getWallClock(t)
+
+	for {
+		if w = s.matchWallClock(w); w.IsZero() {
+			return w
+		}
+
+		// Skip a wall clock time repeated by a daylight saving time change that already
+		// passed, as it only runs the first time
+		if rt := s.getTime(w); !rt.Before(t) {
+			return rt
+		}
+		w = w.Add(time.Second)
+	}
+}
+
+// matchWallClock returns the first wall clock time at or after the wall clock time w that
+// matches the expression, or the zero time if there is none within the year limit
+func (s *Schedule) matchWallClock(w time.Time) time.Time {
+	yearLimit := w.Year() + scheduleYearLimit
+
+	for w.Year() <= yearLimit {
+		if !hasBit(s.month, int(w.Month())) {
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !s.isDay(w) {
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !hasBit(s.hour, w.Hour()) {
+			w = w.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+
+		if !hasBit(s.minute, w.Minute()) {
+			w = w.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+
+		if !hasBit(s.second, w.Second()) {
+			w = w.Add(time.Second)
+			continue
+		}
+
+		return w
+	}
+
+	return time.Time{}
+}
+
+// getTime returns the first time the wall clock in the schedule's time zone shows the wall
+// clock time w. If w is skipped by a daylight saving time change, it returns the time the
+// change ends instead.
+func (s *Schedule) getTime(w time.Time) time.Time {
+	t := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, s.loc)
+	start, end := t.ZoneBounds()
+
+	if tw := getWallClock(t); !tw.Equal(w) {
+		// In a gap, t is moved by its length to either side of it
+		if tw.After(w) {
+			return start
+		}
+		return end
+	}
+
+	// If the wall clock was turned back at the start of t's zone, w may also have been
+	// shown before the change
+	if !start.IsZero() {
+		_, before := start.Add(-time.Second).Zone()
+		_, offset := t.Zone()
+		earlier := t.Add(time.Duration(offset-before) * time.Second)
+		if earlier.Before(start) && getWallClock(earlier).Equal(w) {
+			return earlier
+		}
+	}
+
+	return t
+}
+
+// getWallClock returns the wall clock time of t as a UTC time, so its fields can be stepped
+// without daylight saving time changes
+func getWallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// hasDay checks if any day matches. If only the day of month is restricted, one of the
+// days must exist in one of the months, e.g. 0 0 30 2 * never matches.
+func (s *Schedule) hasDay() bool {
+	if s.domStar || !s.dowStar {
+		return true
+	}
+
+	for m := 1; m <= 12; m++ {
+		if !hasBit(s.month, m) {
+			continue
+		}
+
+		for d := 1; d <= monthDayList[m-1]; d++ {
+			if hasBit(s.dom, d) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isDay checks if the day matches. If both the day of month and day of week are
+// restricted, either can match.
+func (s *Schedule) isDay(t time.Time) bool {
+	domMatch := hasBit(s.dom, t.Day())
+	dowMatch := hasBit(s.dow, int(t.Weekday()))
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+
+	return domMatch || dowMatch
+}
+
+// getBlackout returns the blackout the time is in, or nil
+func (s *Schedule) getBlackout(t time.Time) *Blackout {
+	for _, b := range s.blackoutList {
+		if b.contains(t) {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// contains checks if the time is in the window. For a window that wraps midnight, the
+// part after midnight belongs to the window that started the previous day.
+func (b *Blackout) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+
+	switch {
+	case b.start < b.end:
+		return m >= b.start && m < b.end && b.isWeekday(t.Weekday())
+	case m >= b.start:
+		return b.isWeekday(t.Weekday())
+	case m < b.end:
+		return b.isWeekday((t.Weekday() + 6) % 7)
+	}
+
+	return false
+}
+
+// getEnd returns the end of the window the time is in
+func (b *Blackout) getEnd(t time.Time) time.Time {
+	end := time.Date(t.Year(), t.Month(), t.Day(), b.end/60, b.end%60, 0, 0, t.Location())
+	if !end.After(t) {
+		end = time.Date(t.Year(), t.Month(), t.Day()+1, b.end/60, b.end%60, 0, 0, t.Location())
+	}
+
+	return end
+}
+
+// isWeekday checks if the window starts on the weekday
+func (b *Blackout) isWeekday(wd time.Weekday) bool {
+	if len(b.Weekdays) == 0 {
+		return true
+	}
+
+	for _, bwd := range b.Weekdays {
+		if bwd == wd {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parse parses the field's value into a bit set of the matching values
+func (sf *scheduleField) parse(value string) (bits uint64, err error) {
+	for _, part := range strings.Split(value, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, e.N(ECode0B0108, fmt.Sprintf("invalid %s step: %s", sf.name, part))
+			}
+		}
+
+		start, end := sf.min, sf.max
+		if rangePart != "*" && rangePart != "?" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+			if start, err = sf.parseValue(startPart); err != nil {
+				return 0, e.W(err, ECode0B0109, part)
+			}
+
+			switch {
+			case isRange:
+				if end, err = sf.parseValue(endPart); err != nil {
+					return 0, e.W(err, ECode0B010A, part)
+				}
+			case !hasStep:
+				// A single value, a value with a step runs to the max
+				end = start
+			}
+
+			if start > end {
+				return 0, e.N(ECode0B010B, fmt.Sprintf("invalid %s range: %s", sf.name, part))
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// parseValue parses a single value, either a number or a name, and checks its range
+func (sf *scheduleField) parseValue(value string) (v int, err error) {
+	for i, name := range sf.nameList {
+		if strings.EqualFold(value, name) {
+			return sf.min + i, nil
+		}
+	}
+
+	v, err = strconv.Atoi(value)
+	if err != nil || v < sf.min || v > sf.max {
+		return 0, e.N(ECode0B010C, fmt.Sprintf("invalid %s: %s", sf.name, value))
+	}
+
+	return v, nil
+}
+
+// parseTimeOfDay parses a HH:MM time of day into the minute of the day
+func parseTimeOfDay(value string) (m int, err error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, e.W(err, ECode0B010D, fmt.Sprintf("invalid time of day: %s", value))
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// isStar checks if the field is unrestricted
+func isStar(value string) bool {
+	return strings.HasPrefix(value, "*") || strings.HasPrefix(value, "?")
+}
+
+// hasBit checks if the value is in the bit set
+func hasBit(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
@@ -0,0 +1,95 @@
+package processutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		tz   string
+		t    string
+		want string
+	}{
+		{"daily", "@daily", "", "2026-10-18T10:00:00Z", "2026-10-19T00:00:00Z"},
+		{"daily at the run time", "@daily", "", "2026-10-19T00:00:00Z", "2026-10-20T00:00:00Z"},
+		{"weekdays from friday", "0 9 * * MON-FRI", "", "2026-10-16T10:00:00Z", "2026-10-19T09:00:00Z"},
+		{"weekdays from monday", "0 9 * * MON-FRI", "", "2026-10-19T08:00:00Z", "2026-10-19T09:00:00Z"},
+		{"seconds", "*/30 * * * * *", "", "2026-10-18T10:00:10Z", "2026-10-18T10:00:30Z"},
+		{"leap day", "0 0 29 2 *", "", "2026-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"day of month or week", "0 0 30 2 MON", "", "2026-10-14T00:00:00Z", "2027-02-01T00:00:00Z"},
+		{"time zone", "0 2 * * *", "America/Chicago", "2026-03-01T12:00:00Z", "2026-03-02T08:00:00Z"},
+
+		// Clocks go from 2:00 CST to 3:00 CDT on 2026-03-08
+		{"spring forward skipped", "0 2 * * *", "America/Chicago",
+			"2026-03-07T12:00:00Z", "2026-03-08T08:00:00Z"},
+		{"spring forward skipped in the gap", "30 2 * * *", "America/Chicago",
+			"2026-03-07T12:00:00Z", "2026-03-08T08:00:00Z"},
+		{"spring forward after the gap", "0 2 * * *", "America/Chicago",
+			"2026-03-08T08:00:00Z", "2026-03-09T07:00:00Z"},
+		{"spring forward at the end of the gap", "0 3 * * *", "America/Chicago",
+			"2026-03-07T12:00:00Z", "2026-03-08T08:00:00Z"},
+		{"spring forward hourly", "0 * * * *", "America/Chicago",
+			"2026-03-08T07:30:00Z", "2026-03-08T08:00:00Z"},
+
+		// Clocks go from 2:00 CDT back to 1:00 CST on 2026-11-01
+		{"fall back first", "30 1 * * *", "America/Chicago",
+			"2026-10-31T12:00:00Z", "2026-11-01T06:30:00Z"},
+		{"fall back repeated", "30 1 * * *", "America/Chicago",
+			"2026-11-01T06:30:00Z", "2026-11-02T07:30:00Z"},
+		{"fall back in the repeated hour", "30 1 * * *", "America/Chicago",
+			"2026-11-01T07:10:00Z", "2026-11-02T07:30:00Z"},
+		{"fall back hourly", "0 * * * *", "America/Chicago",
+			"2026-11-01T06:00:00Z", "2026-11-01T08:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.expr, tt.tz)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			from, err := time.Parse(time.RFC3339, tt.t)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, err := time.Parse(time.RFC3339, tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := s.Next(from); !got.Equal(want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.t, got.UTC().Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleError(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		tz   string
+	}{
+		{"impossible date", "0 0 30 2 *", ""},
+		{"impossible dates", "0 0 31 4,6,9,11 *", ""},
+		{"too few fields", "0 0 * *", ""},
+		{"out of range", "0 24 * * *", ""},
+		{"invalid step", "*/0 * * * *", ""},
+		{"invalid range", "0 5-2 * * *", ""},
+		{"unknown macro", "@often", ""},
+		{"unknown time zone", "0 0 * * *", "Nowhere/Special"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseSchedule(tt.expr, tt.tz); err == nil {
+				t.Errorf("ParseSchedule(%q, %q) did not return an error", tt.expr, tt.tz)
+			}
+		})
+	}
+}
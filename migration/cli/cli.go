@@ -0,0 +1,337 @@
+// Package cli implements the golib-migrate command, which runs the migrations of the
+// go-lib packages and any application provided migration lists. The database
+// connection is read from the environment, see sql.GetConnParamFromENV. An application
+// can build its own command with the lists it uses:
+//
+//	func main() {
+//		if err := cli.Run(os.Args[1:], process.GetMigrationList(),
+//			app.GetMigrationList()); err != nil {
+//			fmt.Fprintln(os.Stderr, err)
+//			os.Exit(1)
+//		}
+//	}
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/migration"
+	"github.com/Skyrin/go-lib/sql"
+)
+
+const (
+	usage = `Usage: golib-migrate [flags] <command> [args]
+
+Commands:
+  status                    Show the applied, pending and failed versions per code
+  up [code] [version]       Upgrade all codes, or the code up to the version
+  down <code> <version>     Revert the code's versions after the version
+  create <code> <name>      Create the next numbered up/down files for the code
+  verify                    Report edited, missing and unknown versions
+  lint                      Report pending SQL that takes long locks on existing tables
+  mark-applied <code> <v>   Mark the code's versions up to v as applied, without running them
+
+Flags:
+`
+
+	ECode000701 = e.Code0007 + "01"
+	ECode000702 = e.Code0007 + "02"
+	ECode000703 = e.Code0007 + "03"
+	ECode000704 = e.Code0007 + "04"
+	ECode000705 = e.Code0007 + "05"
+	ECode000706 = e.Code0007 + "06"
+	ECode000707 = e.Code0007 + "07"
+	ECode000708 = e.Code0007 + "08"
+	ECode000709 = e.Code0007 + "09"
+	ECode00070A = e.Code0007 + "0A"
+	ECode00070B = e.Code0007 + "0B"
+	ECode00070C = e.Code0007 + "0C"
+	ECode00070D = e.Code0007 + "0D"
+	ECode00070E = e.Code0007 + "0E"
+	ECode00070F = e.Code0007 + "0F"
+	ECode000710 = e.Code0007 + "10"
+	ECode000711 = e.Code0007 + "11"
+	ECode000712 = e.Code0007 + "12"
+	ECode000713 = e.Code0007 + "13"
+	ECode000714 = e.Code0007 + "14"
+	ECode000715 = e.Code0007 + "15"
+	ECode000716 = e.Code0007 + "16"
+)
+
+var nameRegex = regexp.MustCompile(`[^a-z0-9]+`)
+
+// cli the parsed command line
+type cli struct {
+	out         io.Writer
+	lockWait    time.Duration
+	strict      bool
+	safety      string
+	lockTimeout time.Duration
+	dir         string
+	cmd         string
+	argList     []string
+	mlList      []*migration.List
+}
+
+// Run parses the arguments and runs the command against the migration lists, which are
+// added to the migrator in the order they are passed. Output is written to stdout.
+func Run(args []string, mlList ...*migration.List) (err error) {
+	c := &cli{
+		out:    os.Stdout,
+		mlList: mlList,
+	}
+
+	fs := flag.NewFlagSet("golib-migrate", flag.ContinueOnError)
+	fs.DurationVar(&c.lockWait, "lock-wait", migration.MIGRATION_LOCK_WAIT,
+		"how long to wait for the migration lock, 0 skips the upgrade if it is held")
+	fs.BoolVar(&c.strict, "strict", false, "refuse to upgrade if verify reports drift")
+	fs.StringVar(&c.safety, "safety", string(migration.SafetyWarn),
+		"how up handles unsafe pending SQL, see lint: off, warn or block")
+	fs.DurationVar(&c.lockTimeout, "lock-timeout", migration.MIGRATION_LOCK_TIMEOUT,
+		"lock_timeout while running migration files, 0 disables it")
+	fs.StringVar(&c.dir, "dir", "",
+		"directory to create files in, defaults to <code>/db/migrations")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return e.W(err, ECode000701)
+	}
+
+	switch migration.SafetyMode(c.safety) {
+	case migration.SafetyOff, migration.SafetyWarn, migration.SafetyBlock:
+	default:
+		return e.N(ECode000716, fmt.Sprintf("invalid safety: %s", c.safety))
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return e.N(ECode000702, "a command is required")
+	}
+	c.cmd = fs.Arg(0)
+	c.argList = fs.Args()[1:]
+
+	// Create does not need a database connection
+	if c.cmd == "create" {
+		if err := c.create(); err != nil {
+			return e.W(err, ECode000703)
+		}
+		return nil
+	}
+
+	db, err := sql.NewPostgresConn(nil)
+	if err != nil {
+		return e.W(err, ECode000704)
+	}
+	defer db.DB.Close()
+
+	m, err := migration.NewMigrator(db)
+	if err != nil {
+		return e.W(err, ECode000705)
+	}
+	m.SetLockWait(c.lockWait)
+	m.SetStrict(c.strict)
+	m.SetSafety(migration.SafetyMode(c.safety))
+	m.SetLockTimeout(c.lockTimeout)
+
+	for _, ml := range c.mlList {
+		if err := m.AddMigrationList(ml); err != nil {
+			return e.W(err, ECode000706)
+		}
+	}
+
+	switch c.cmd {
+	case "status":
+		err = c.status(m)
+	case "up":
+		err = c.up(m)
+	case "down":
+		err = c.down(m)
+	case "verify":
+		err = c.verify(m)
+	case "lint":
+		err = c.lint(m)
+	case "mark-applied":
+		err = c.markApplied(m)
+	default:
+		fs.Usage()
+		return e.N(ECode000707, fmt.Sprintf("unknown command: %s", c.cmd))
+	}
+
+	if err != nil {
+		return e.W(err, ECode000708, c.cmd)
+	}
+
+	return nil
+}
+
+// status prints the applied, pending and failed versions per code
+func (c *cli) status(m *migration.Migrator) (err error) {
+	lsList, err := m.Status()
+	if err != nil {
+		return e.W(err, ECode000709)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CODE\tVERSION\tAPPLIED\tPENDING\tFAILED")
+	for _, ls := range lsList {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", ls.Code, ls.Version, len(ls.Applied),
+			joinVersions(ls.Pending), joinVersions(ls.Failed))
+	}
+
+	return tw.Flush()
+}
+
+// up upgrades all codes, or the code up to the optional version
+func (c *cli) up(m *migration.Migrator) (err error) {
+	if len(c.argList) == 0 {
+		return m.Upgrade()
+	}
+
+	version := 0
+	if len(c.argList) > 1 {
+		version, err = strconv.Atoi(c.argList[1])
+		if err != nil {
+			return e.W(err, ECode00070A, c.argList[1])
+		}
+	}
+
+	if err := m.UpgradeTo(c.argList[0], version); err != nil {
+		return e.W(err, ECode00070B)
+	}
+
+	return nil
+}
+
+// down reverts the code's versions after the target version
+func (c *cli) down(m *migration.Migrator) (err error) {
+	code, version, err := c.getCodeAndVersion()
+	if err != nil {
+		return e.W(err, ECode00070C)
+	}
+
+	return m.Downgrade(code, version)
+}
+
+// verify prints the drift and returns an error if there is any
+func (c *cli) verify(m *migration.Migrator) (err error) {
+	driftList, err := m.Verify()
+	if err != nil {
+		return e.W(err, ECode00070D)
+	}
+
+	for _, d := range driftList {
+		fmt.Fprintln(c.out, d.String())
+	}
+
+	if len(driftList) > 0 {
+		return e.N(ECode00070E, e.MsgMigrationDrift)
+	}
+
+	return nil
+}
+
+// lint prints the safety issues of the pending files and returns an error if there are
+// any
+func (c *cli) lint(m *migration.Migrator) (err error) {
+	siList := m.CheckSafety()
+	for _, si := range siList {
+		fmt.Fprintln(c.out, si.String())
+	}
+
+	if len(siList) > 0 {
+		return e.N(ECode000715, e.MsgMigrationUnsafe)
+	}
+
+	return nil
+}
+
+// markApplied marks the code's versions up to the version as applied
+func (c *cli) markApplied(m *migration.Migrator) (err error) {
+	code, version, err := c.getCodeAndVersion()
+	if err != nil {
+		return e.W(err, ECode00070F)
+	}
+
+	return m.MarkApplied(code, version)
+}
+
+// create creates the next numbered up and down files for the code
+func (c *cli) create() (err error) {
+	if len(c.argList) != 2 {
+		return e.N(ECode000710, "usage: create <code> <name>")
+	}
+
+	dir := c.dir
+	if dir == "" {
+		dir = filepath.Join(c.argList[0], migration.MIGRATION_PATH)
+	}
+
+	dirList, err := os.ReadDir(dir)
+	if err != nil {
+		return e.W(err, ECode000711)
+	}
+
+	version := 0
+	for _, de := range dirList {
+		f := &migration.File{Name: de.Name()}
+		if de.IsDir() || !strings.HasSuffix(f.Name, ".sql") {
+			continue
+		}
+
+		if v, err := f.GetVersionFromName(); err == nil && v > version {
+			version = v
+		}
+	}
+
+	name := strings.Trim(nameRegex.ReplaceAllString(strings.ToLower(c.argList[1]), "_"), "_")
+	for _, suffix := range []string{"up", "down"} {
+		path := filepath.Join(dir, fmt.Sprintf("%06d_%s.%s.sql", version+1, name, suffix))
+		if err := os.WriteFile(path, []byte("BEGIN;\n\nCOMMIT;\n"), 0644); err != nil {
+			return e.W(err, ECode000712)
+		}
+		fmt.Fprintln(c.out, path)
+	}
+
+	return nil
+}
+
+// getCodeAndVersion returns the code and version arguments
+func (c *cli) getCodeAndVersion() (code string, version int, err error) {
+	if len(c.argList) != 2 {
+		return "", 0, e.N(ECode000713, fmt.Sprintf("usage: %s <code> <version>", c.cmd))
+	}
+
+	version, err = strconv.Atoi(c.argList[1])
+	if err != nil {
+		return "", 0, e.W(err, ECode000714, c.argList[1])
+	}
+
+	return c.argList[0], version, nil
+}
+
+// joinVersions joins the versions with a comma, or returns - if there are none
+func joinVersions(vList []int) string {
+	if len(vList) == 0 {
+		return "-"
+	}
+
+	sList := make([]string, len(vList))
+	for i, v := range vList {
+		sList[i] = strconv.Itoa(v)
+	}
+
+	return strings.Join(sList, ",")
+}
@@ -0,0 +1,4 @@
+-- migrate:no-transaction
+-- Adds the status of migrations reverted by their down file. Older versions of
+-- Postgres can not add an enum value in a txn block.
+ALTER TYPE skyrin_migration_status ADD VALUE IF NOT EXISTS 'reverted';
@@ -0,0 +1,13 @@
+BEGIN;
+
+-- Adds the run history of each migration: when its latest attempt started and finished,
+-- how long it took, the host and app version that ran it and the number of attempts
+ALTER TABLE skyrin_migration
+	ADD COLUMN IF NOT EXISTS skyrin_migration_started_on TIMESTAMP NULL,
+	ADD COLUMN IF NOT EXISTS skyrin_migration_finished_on TIMESTAMP NULL,
+	ADD COLUMN IF NOT EXISTS skyrin_migration_duration_ms BIGINT NULL,
+	ADD COLUMN IF NOT EXISTS skyrin_migration_host TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS skyrin_migration_app_version TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS skyrin_migration_attempts INT NOT NULL DEFAULT 0;
+
+COMMIT;
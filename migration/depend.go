@@ -0,0 +1,142 @@
+package migration
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Skyrin/go-lib/e"
+)
+
+const (
+	ECode000801 = e.Code0008 + "01"
+	ECode000802 = e.Code0008 + "02"
+	ECode000803 = e.Code0008 + "03"
+	ECode000804 = e.Code0008 + "04"
+	ECode000805 = e.Code0008 + "05"
+	ECode000806 = e.Code0008 + "06"
+)
+
+// dependency a migration list's dependency on another list being at a version
+type dependency struct {
+	code    string
+	version int
+}
+
+// DependsOn declares that the list's migrations need the migration list with the code
+// to be at least at the version, e.g. because they reference its tables. The migrator
+// upgrades the lists in dependency order, regardless of the order they were added,
+// and fails if a dependency can not be met or the dependencies form a cycle.
+func (l *List) DependsOn(code string, version int) *List {
+	l.dependList = append(l.dependList, &dependency{
+		code:    code,
+		version: version,
+	})
+
+	return l
+}
+
+// hasVersion checks if the migration list has the version, either complete or in its
+// files still to run
+func (l *List) hasVersion(v int) bool {
+	if v <= l.version {
+		return true
+	}
+
+	for _, f := range l.files {
+		if f.Version == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getUpgradeOrder returns the migration lists sorted so each list comes after the lists
+// it depends on, otherwise keeping the order they were added. It returns an error if
+// a dependency is not added to the migrator, does not have the version or if the
+// dependencies form a cycle.
+func (m *Migrator) getUpgradeOrder() (mlList []*List, err error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	stateMap := make(map[string]int, len(m.migrations))
+	mlList = make([]*List, 0, len(m.migrations))
+	path := []string{}
+
+	var visit func(ml *List) error
+	visit = func(ml *List) error {
+		switch stateMap[ml.code] {
+		case visited:
+			return nil
+		case visiting:
+			return e.N(ECode000801, fmt.Sprintf("%s: %s -> %s", e.MsgMigrationDependencyCycle,
+				strings.Join(path, " -> "), ml.code))
+		}
+
+		stateMap[ml.code] = visiting
+		path = append(path, ml.code)
+		for _, d := range ml.dependList {
+			dl, err := m.getList(d.code)
+			if err != nil {
+				return e.N(ECode000802, fmt.Sprintf("%s: %s depends on %s/%d, which is not added",
+					e.MsgMigrationDependencyUnmet, ml.code, d.code, d.version))
+			}
+
+			if !dl.hasVersion(d.version) {
+				return e.N(ECode000803, fmt.Sprintf("%s: %s depends on %s/%d, which does not exist",
+					e.MsgMigrationDependencyUnmet, ml.code, d.code, d.version))
+			}
+
+			if err := visit(dl); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		stateMap[ml.code] = visited
+		mlList = append(mlList, ml)
+
+		return nil
+	}
+
+	for _, ml := range m.migrations {
+		if err := visit(ml); err != nil {
+			return nil, e.W(err, ECode000804)
+		}
+	}
+
+	return mlList, nil
+}
+
+// checkDependencies checks the lists the migration list depends on are at the required
+// versions, so it can be upgraded
+func (m *Migrator) checkDependencies(ml *List) (err error) {
+	for _, d := range ml.dependList {
+		dl, err := m.getList(d.code)
+		if err != nil || dl.version < d.version {
+			return e.N(ECode000805, fmt.Sprintf("%s: %s depends on %s/%d, which is not complete",
+				e.MsgMigrationDependencyUnmet, ml.code, d.code, d.version))
+		}
+	}
+
+	return nil
+}
+
+// checkDependents checks no migration list that depends on the migration list needs a
+// version after the target version, so it can be downgraded to it
+func (m *Migrator) checkDependents(ml *List, targetVersion int) (err error) {
+	for _, dl := range m.migrations {
+		if dl.version == 0 {
+			continue
+		}
+
+		for _, d := range dl.dependList {
+			if d.code == ml.code && d.version > targetVersion {
+				return e.N(ECode000806, fmt.Sprintf("%s: %s depends on %s/%d",
+					e.MsgMigrationDependencyUnmet, dl.code, d.code, d.version))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package migration
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MIGRATION_LOCK_WAIT the default time to wait for the migration lock
+	MIGRATION_LOCK_WAIT = 5 * time.Minute
+	// MIGRATION_LOCK_POLL how often to retry taking the migration lock while waiting
+	MIGRATION_LOCK_POLL = time.Second
+
+	ECode000401 = e.Code0004 + "01"
+	ECode000402 = e.Code0004 + "02"
+	ECode000403 = e.Code0004 + "03"
+	ECode000404 = e.Code0004 + "04"
+)
+
+// SetLockWait sets how long the migrator waits for the migration lock if another
+// instance holds it. If wait is 0, Upgrade does not wait and skips the upgrade
+// instead, leaving it to the instance holding the lock.
+func (m *Migrator) SetLockWait(wait time.Duration) {
+	m.lockWait = wait
+}
+
+// lock takes the Postgres advisory lock for migrations, so only one instance migrates
+// at a time. The lock is held by a dedicated connection until unlock is called. If
+// another instance holds the lock, it waits up to the lock wait, then returns false.
+func (m *Migrator) lock() (acquired bool, err error) {
+	ctx := context.Background()
+	conn, err := m.db.DB.Conn(ctx)
+	if err != nil {
+		return false, e.W(err, ECode000401)
+	}
+
+	deadline := time.Now().Add(m.lockWait)
+	for {
+		if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`,
+			MIGRATION_TABLE).Scan(&acquired); err != nil {
+			_ = conn.Close()
+			return false, e.W(err, ECode000402)
+		}
+
+		if acquired {
+			m.lockConn = conn
+			log.Info().Str("instance", m.instance).Msg("acquired migration lock")
+			return true, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			_ = conn.Close()
+			return false, nil
+		}
+
+		log.Info().Str("instance", m.instance).
+			Msg("waiting for migration lock held by another instance")
+		time.Sleep(MIGRATION_LOCK_POLL)
+	}
+}
+
+// mustLock takes the migration lock, returning an error if it could not be acquired
+func (m *Migrator) mustLock() (err error) {
+	acquired, err := m.lock()
+	if err != nil {
+		return e.W(err, ECode000403)
+	}
+
+	if !acquired {
+		return e.N(ECode000404, e.MsgMigrationLocked)
+	}
+
+	return nil
+}
+
+// unlock releases the migration lock. If releasing fails, the connection holding the
+// lock is discarded instead of returned to the pool, which also releases it.
+func (m *Migrator) unlock() {
+	if m.lockConn == nil {
+		return
+	}
+
+	conn := m.lockConn
+	m.lockConn = nil
+
+	if _, err := conn.ExecContext(context.Background(),
+		`SELECT pg_advisory_unlock(hashtext($1))`, MIGRATION_TABLE); err != nil {
+		log.Error().Err(err).Str("instance", m.instance).Msg("[Migrator.unlock]")
+		_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+
+	_ = conn.Close()
+}
+
+// getInstance returns the name of this instance, used to log which instance migrated
+func getInstance() string {
+	return fmt.Sprintf("%s:%d", getHost(), os.Getpid())
+}
+
+// getHost returns the host name, or unknown if it can not be determined
+func getHost() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+
+	return host
+}
@@ -0,0 +1,38 @@
+package migration
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripTransaction(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{"own lines", "BEGIN;\nCREATE TABLE a (id INT);\nCOMMIT;", "CREATE TABLE a (id INT);"},
+		{"start transaction and end", "START TRANSACTION;\nCREATE TABLE a (id INT);\nEND;",
+			"CREATE TABLE a (id INT);"},
+		{"begin work and commit transaction", "begin work;\nCREATE TABLE a (id INT);\ncommit transaction;",
+			"CREATE TABLE a (id INT);"},
+		{"same line as statements", "BEGIN; CREATE TABLE a (id INT);\nCREATE TABLE b (id INT); COMMIT;",
+			"CREATE TABLE a (id INT);\nCREATE TABLE b (id INT);"},
+		{"one line", "BEGIN; CREATE TABLE a (id INT); COMMIT;", "CREATE TABLE a (id INT);"},
+		{"header and comments", "-- header\nBEGIN;\nCREATE TABLE a (id INT);\nCOMMIT;\n-- done",
+			"-- header\n\nCREATE TABLE a (id INT);\n\n-- done"},
+		{"no txn", "CREATE TABLE a (id INT);", "CREATE TABLE a (id INT);"},
+		{"begin only", "BEGIN;\nCREATE TABLE a (id INT);", "BEGIN;\nCREATE TABLE a (id INT);"},
+		{"commit only", "CREATE TABLE a (id INT);\nCOMMIT;", "CREATE TABLE a (id INT);\nCOMMIT;"},
+		{"plpgsql block", "DO $$\nBEGIN\nPERFORM 1;\nEND;\n$$;", "DO $$\nBEGIN\nPERFORM 1;\nEND;\n$$;"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.TrimSpace(string(stripTransaction([]byte(tt.sql))))
+			if got != tt.want {
+				t.Errorf("stripTransaction() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
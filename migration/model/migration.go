@@ -1,21 +1,32 @@
 package model
 
+import "time"
+
 type MigrationStatus string
 
 const (
 	MIGRATION_STATUS_PENDING  = "pending"
 	MIGRATION_STATUS_FAILED   = "failed"
 	MIGRATION_STATUS_COMPLETE = "complete"
+	MIGRATION_STATUS_REVERTED = "reverted"
 )
 
 // Migration
 type Migration struct {
-	ID        int
-	Code      string
-	Version   int
-	Status    MigrationStatus
-	SQL       string
-	Err       string
-	CreatedOn string
-	UpdatedOn string
+	ID       int
+	Code     string
+	Version  int
+	Status   MigrationStatus
+	SQL      string
+	Err      string
+	Checksum string
+	// Run history of the latest attempt
+	StartedOn  string
+	FinishedOn string
+	Duration   time.Duration
+	Host       string // Host that ran it
+	AppVersion string // App version that ran it, see lib.Version
+	Attempts   int
+	CreatedOn  string
+	UpdatedOn  string
 }
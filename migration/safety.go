@@ -0,0 +1,404 @@
+package migration
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MIGRATION_LOCK_TIMEOUT the default lock_timeout while running migration files
+	MIGRATION_LOCK_TIMEOUT = 10 * time.Second
+	// MIGRATION_ALLOW the comment directive that suppresses safety rules for the statement
+	// it precedes, or follows on the same line, e.g. -- migrate:allow create-index
+	MIGRATION_ALLOW = "-- migrate:allow"
+
+	SafetyOff   = SafetyMode("off")   // Pending files are not checked
+	SafetyWarn  = SafetyMode("warn")  // Issues are logged, the upgrade continues
+	SafetyBlock = SafetyMode("block") // Issues fail the upgrade before any file runs
+
+	// ALTER TABLE ... ADD COLUMN ... NOT NULL without a default
+	SafetyAddColumnNotNull = SafetyRule("add-column-not-null")
+	// CREATE INDEX without CONCURRENTLY
+	SafetyCreateIndex = SafetyRule("create-index")
+	// ALTER TABLE ... ALTER COLUMN ... TYPE, which rewrites the table
+	SafetyAlterColumnType = SafetyRule("alter-column-type")
+
+	ECode000A01 = e.Code000A + "01"
+	ECode000A02 = e.Code000A + "02"
+	ECode000A03 = e.Code000A + "03"
+	ECode000A04 = e.Code000A + "04"
+	ECode000A05 = e.Code000A + "05"
+)
+
+var (
+	createTableRegex = regexp.MustCompile(
+		`^CREATE (?:(?:GLOBAL |LOCAL )?(?:TEMP|TEMPORARY|UNLOGGED) )?TABLE (?:IF NOT EXISTS )?(\S+)`)
+	alterTableRegex = regexp.MustCompile(
+		`^ALTER TABLE (?:IF EXISTS )?(?:ONLY )?(\S+) (.*)$`)
+	createIndexRegex = regexp.MustCompile(
+		`^CREATE (?:UNIQUE )?INDEX( CONCURRENTLY)?(?: .*?)? ON (?:ONLY )?([^\s(]+)`)
+	addColumnRegex = regexp.MustCompile(
+		`^ADD (?:COLUMN )?(?:IF NOT EXISTS )?`)
+	addConstraintRegex = regexp.MustCompile(
+		`^ADD (?:CONSTRAINT|PRIMARY KEY|UNIQUE|FOREIGN KEY|CHECK|EXCLUDE)\b`)
+	alterColumnTypeRegex = regexp.MustCompile(
+		`^ALTER (?:COLUMN )?\S+ (?:SET DATA )?TYPE `)
+	notNullRegex = regexp.MustCompile(`\bNOT NULL\b`)
+	defaultRegex = regexp.MustCompile(`\bDEFAULT\b`)
+)
+
+// SafetyMode how pending migration files that take long locks on existing tables are
+// handled by Upgrade, see SetSafety
+type SafetyMode string
+
+// SafetyRule a known-dangerous SQL pattern
+type SafetyRule string
+
+// SafetyIssue a statement of a pending migration file that breaks a safety rule
+type SafetyIssue struct {
+	Code      string
+	Version   int
+	Line      int // Line of the file the statement starts on
+	Rule      SafetyRule
+	Statement string
+}
+
+// String returns the issue in a human readable format
+func (si *SafetyIssue) String() string {
+	return fmt.Sprintf("%s/%d line %d: %s: %s", si.Code, si.Version, si.Line, si.Rule,
+		si.Statement)
+}
+
+// statement a single SQL statement of a file
+type statement struct {
+	line     int
+	sql      string // Comments removed and whitespace collapsed
+	allowMap map[SafetyRule]bool
+}
+
+// SetSafety sets how Upgrade handles pending files that break a safety rule, defaults
+// to SafetyWarn. A statement can be allowed to break a rule with a comment directive
+// before it, e.g.
+//
+//	-- migrate:allow create-index
+//	CREATE INDEX small_table__idx ON small_table (name);
+func (m *Migrator) SetSafety(mode SafetyMode) {
+	m.safety = mode
+}
+
+// SetLockTimeout sets the lock_timeout while running migration files, so a statement
+// waiting on a lock held by the app fails instead of blocking all queries queued behind
+// it. Defaults to MIGRATION_LOCK_TIMEOUT, 0 disables it. It is not set for no-transaction
+// files, unless they opt in with the lock timeout directive, see
+// MIGRATION_LOCK_TIMEOUT_DIRECTIVE.
+func (m *Migrator) SetLockTimeout(timeout time.Duration) {
+	m.lockTimeout = timeout
+}
+
+// CheckSafety returns the safety issues of the pending files of all migration lists
+func (m *Migrator) CheckSafety() (siList []*SafetyIssue) {
+	return m.getSafetyIssues(m.migrations, 0)
+}
+
+// checkSafety checks the pending files of the lists, up to the max version if not 0,
+// before any of them run. Issues are logged, or returned as an error if blocking.
+func (m *Migrator) checkSafety(mlList []*List, maxVersion int) (err error) {
+	if m.safety == SafetyOff {
+		return nil
+	}
+
+	siList := m.getSafetyIssues(mlList, maxVersion)
+	if len(siList) == 0 {
+		return nil
+	}
+
+	if m.safety == SafetyBlock {
+		msgList := make([]string, len(siList))
+		for i, si := range siList {
+			msgList[i] = si.String()
+		}
+		return e.N(ECode000A01, fmt.Sprintf("%s: %s", e.MsgMigrationUnsafe,
+			strings.Join(msgList, "; ")))
+	}
+
+	for _, si := range siList {
+		log.Warn().Str("instance", m.instance).Str("code", si.Code).
+			Int("version", si.Version).Int("line", si.Line).Str("rule", string(si.Rule)).
+			Msg(e.MsgMigrationUnsafe)
+	}
+
+	return nil
+}
+
+// getSafetyIssues returns the safety issues of the SQL files of the lists that are
+// newer than their latest complete version, up to the max version if not 0
+func (m *Migrator) getSafetyIssues(mlList []*List, maxVersion int) (siList []*SafetyIssue) {
+	siList = []*SafetyIssue{}
+	for _, ml := range mlList {
+		for _, f := range ml.files {
+			if maxVersion > 0 && f.Version > maxVersion {
+				break
+			}
+
+			if f.Version <= ml.version || f.Func != nil {
+				continue
+			}
+
+			for _, si := range LintSQL(f.SQL) {
+				si.Code = ml.code
+				si.Version = f.Version
+				siList = append(siList, si)
+			}
+		}
+	}
+
+	return siList
+}
+
+// LintSQL returns the statements of the SQL that break a safety rule, unless allowed by
+// a comment directive. Changes to tables created earlier in the same SQL are ignored, as
+// nothing else can be using them yet.
+func LintSQL(fileSQL []byte) (siList []*SafetyIssue) {
+	siList = []*SafetyIssue{}
+	newTableMap := map[string]bool{}
+
+	for _, stmt := range splitStatements(string(fileSQL)) {
+		norm := strings.ToUpper(stmt.sql)
+
+		if matchList := createTableRegex.FindStringSubmatch(norm); matchList != nil {
+			newTableMap[getTableName(matchList[1])] = true
+			continue
+		}
+
+		ruleList := []SafetyRule{}
+		if matchList := createIndexRegex.FindStringSubmatch(norm); matchList != nil {
+			if matchList[1] == "" && !newTableMap[getTableName(matchList[2])] {
+				ruleList = append(ruleList, SafetyCreateIndex)
+			}
+		}
+
+		if matchList := alterTableRegex.FindStringSubmatch(norm); matchList != nil &&
+			!newTableMap[getTableName(matchList[1])] {
+			ruleList = append(ruleList, getAlterTableRules(matchList[2])...)
+		}
+
+		for _, rule := range ruleList {
+			if stmt.allowMap[rule] {
+				continue
+			}
+
+			siList = append(siList, &SafetyIssue{
+				Line:      stmt.line,
+				Rule:      rule,
+				Statement: stmt.sql,
+			})
+		}
+	}
+
+	return siList
+}
+
+// getAlterTableRules returns the rules broken by the actions of an ALTER TABLE statement
+func getAlterTableRules(actions string) (ruleList []SafetyRule) {
+	ruleList = []SafetyRule{}
+	for _, action := range splitTopLevel(actions, ',') {
+		action = strings.TrimSpace(action)
+
+		switch {
+		case addConstraintRegex.MatchString(action):
+			// Constraints are not columns, ADD COLUMN is optional
+		case addColumnRegex.MatchString(action):
+			if notNullRegex.MatchString(action) && !defaultRegex.MatchString(action) {
+				ruleList = append(ruleList, SafetyAddColumnNotNull)
+			}
+		case alterColumnTypeRegex.MatchString(action):
+			ruleList = append(ruleList, SafetyAlterColumnType)
+		}
+	}
+
+	return ruleList
+}
+
+// getTableName returns the table name without quotes and the default public schema, so
+// the same table always has the same name
+func getTableName(name string) string {
+	name = strings.ReplaceAll(name, `"`, "")
+	return strings.TrimPrefix(name, "PUBLIC.")
+}
+
+// splitTopLevel splits the string on the separator, ignoring separators in parentheses
+func splitTopLevel(s string, sep rune) (partList []string) {
+	depth := 0
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == sep && depth == 0:
+			partList = append(partList, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(partList, s[start:])
+}
+
+// splitStatements splits the SQL into its statements, skipping string literals, quoted
+// identifiers, dollar quoted bodies and comments. Comment directives apply to the
+// statement they precede, or the statement ending earlier on the same line.
+func splitStatements(s string) (stmtList []*statement) {
+	r := []rune(s)
+	sb := strings.Builder{}
+	line := 1
+	startLine := 0
+	endLine := 0 // Line the previous statement ended on
+	allowMap := map[SafetyRule]bool{}
+
+	write := func(c rune) {
+		if startLine == 0 && !unicode.IsSpace(c) {
+			startLine = line
+		}
+		_, _ = sb.WriteRune(c)
+	}
+	flush := func() {
+		if sql := strings.Join(strings.Fields(sb.String()), " "); sql != "" {
+			stmtList = append(stmtList, &statement{
+				line:     startLine,
+				sql:      sql,
+				allowMap: allowMap,
+			})
+			allowMap = map[SafetyRule]bool{}
+		}
+		sb.Reset()
+		startLine = 0
+	}
+
+	for i := 0; i < len(r); i++ {
+		c := r[i]
+		switch {
+		case c == '\n':
+			line++
+			_, _ = sb.WriteRune(c)
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			j := i
+			for j < len(r) && r[j] != '\n' {
+				j++
+			}
+			comment := string(r[i:j])
+			i = j - 1
+
+			if !strings.HasPrefix(comment, MIGRATION_ALLOW) {
+				continue
+			}
+
+			// A directive following a statement on the same line applies to it
+			m := allowMap
+			if startLine == 0 && line == endLine && len(stmtList) > 0 {
+				m = stmtList[len(stmtList)-1].allowMap
+			}
+			for _, rule := range strings.FieldsFunc(strings.TrimPrefix(comment, MIGRATION_ALLOW),
+				func(c rune) bool { return c == ',' || c == ' ' || c == '\t' }) {
+				m[SafetyRule(rule)] = true
+			}
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			for i += 2; i < len(r) && !(r[i] == '*' && i+1 < len(r) && r[i+1] == '/'); i++ {
+				if r[i] == '\n' {
+					line++
+				}
+			}
+			i++
+			_, _ = sb.WriteRune(' ')
+		case c == '\'' || c == '"':
+			write(c)
+			for i++; i < len(r); i++ {
+				if r[i] == '\n' {
+					line++
+				}
+				_, _ = sb.WriteRune(r[i])
+				if r[i] == c {
+					break
+				}
+			}
+		case c == '$':
+			// Dollar quote, e.g. $$ or $body$, skip to the closing tag. A bind
+			// parameter, e.g. $1, is not a tag.
+			j := i + 1
+			for j < len(r) && (r[j] == '_' || unicode.IsLetter(r[j]) ||
+				(j > i+1 && unicode.IsDigit(r[j]))) {
+				j++
+			}
+			if j >= len(r) || r[j] != '$' {
+				write(c)
+				continue
+			}
+
+			tag := string(r[i : j+1])
+			body := string(r[i:])
+			if end := strings.Index(body[len(tag):], tag); end >= 0 {
+				body = body[:len(tag)+end+len(tag)]
+			}
+			write(' ')
+			_, _ = sb.WriteString(body)
+			line += strings.Count(body, "\n")
+			i += len([]rune(body)) - 1
+		case c == ';':
+			flush()
+			endLine = line
+		default:
+			write(c)
+		}
+	}
+	flush()
+
+	return stmtList
+}
+
+// execNoTransaction runs the SQL of a no-transaction file. If the file has the lock
+// timeout directive, it runs on a dedicated connection with the lock timeout set, which
+// is reset before the connection returns to the pool.
+func (m *Migrator) execNoTransaction(fileSQL []byte) (err error) {
+	if m.lockTimeout <= 0 || !hasLockTimeoutDirective(fileSQL) {
+		if _, err := m.db.Exec(string(fileSQL)); err != nil {
+			return e.W(err, ECode000A02)
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	conn, err := m.db.DB.Conn(ctx)
+	if err != nil {
+		return e.W(err, ECode000A03)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, getLockTimeoutSQL("SET", m.lockTimeout)); err != nil {
+		return e.W(err, ECode000A04)
+	}
+
+	_, err = conn.ExecContext(ctx, string(fileSQL))
+	if _, err := conn.ExecContext(ctx, `RESET lock_timeout`); err != nil {
+		// Do not return the connection to the pool with the lock timeout still set
+		_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	if err != nil {
+		return e.W(err, ECode000A05)
+	}
+
+	return nil
+}
+
+// getLockTimeoutSQL returns the SET statement for the lock timeout, e.g. SET LOCAL
+// within a txn
+func getLockTimeoutSQL(set string, timeout time.Duration) string {
+	return fmt.Sprintf("%s lock_timeout='%dms'", set, timeout.Milliseconds())
+}
@@ -3,7 +3,9 @@ package sqlmodel
 import (
 	"fmt"
 	"strings"
+	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	"github.com/Skyrin/go-lib/e"
 	"github.com/Skyrin/go-lib/migration/model"
 	"github.com/Skyrin/go-lib/sql"
@@ -24,6 +26,16 @@ const (
 	ECode000309 = e.Code0003 + "09"
 	ECode00030A = e.Code0003 + "0A"
 	ECode00030B = e.Code0003 + "0B"
+	ECode00030C = e.Code0003 + "0C"
+	ECode00030D = e.Code0003 + "0D"
+	ECode00030E = e.Code0003 + "0E"
+	ECode00030F = e.Code0003 + "0F"
+	ECode000310 = e.Code0003 + "10"
+	ECode000311 = e.Code0003 + "11"
+	ECode000312 = e.Code0003 + "12"
+	ECode000313 = e.Code0003 + "13"
+	ECode000314 = e.Code0003 + "14"
+	ECode000315 = e.Code0003 + "15"
 )
 
 // MigrationGetParam get params
@@ -32,6 +44,7 @@ type MigrationGetParam struct {
 	Offset         uint64
 	ID             *int
 	Version        *int
+	MinVersion     *int // Only return migrations with a version greater or equal to this
 	Code           *string
 	Status         *string
 	FlagCount      bool
@@ -45,6 +58,12 @@ type MigrationUpdateParam struct {
 	Status  *string
 	SQL     *string
 	Err     *string
+	// Checksum of the SQL, the column is added by the migrator's own migrations, so
+	// only set it once they have run
+	Checksum *string
+	// Duration of the run, also sets the finished on time. Like the checksum, only set
+	// it once the migrator's own migrations have added the history columns
+	Duration *time.Duration
 }
 
 // MigrationInsertParam insert params
@@ -103,6 +122,15 @@ func MigrationUpdate(db *sql.Connection, id int, up *MigrationUpdateParam) (err
 		ub = ub.Set("skyrin_migration_err", *up.Err)
 	}
 
+	if up.Checksum != nil {
+		ub = ub.Set("skyrin_migration_checksum", *up.Checksum)
+	}
+
+	if up.Duration != nil {
+		ub = ub.Set("skyrin_migration_finished_on", "now()").
+			Set("skyrin_migration_duration_ms", up.Duration.Milliseconds())
+	}
+
 	err = db.ExecUpdate(ub)
 	if err != nil {
 		return e.W(err, ECode000302,
@@ -136,6 +164,10 @@ func MigrationGet(db *sql.Connection,
 		sb = sb.Where("skyrin_migration_version=?", *p.Version)
 	}
 
+	if p.MinVersion != nil {
+		sb = sb.Where("skyrin_migration_version>=?", *p.MinVersion)
+	}
+
 	if p.Code != nil {
 		sb = sb.Where("skyrin_migration_code=?", *p.Code)
 	}
@@ -234,3 +266,125 @@ func MigrationGetLatest(db *sql.Connection, code string) (m *model.Migration, er
 
 	return mList[0], nil
 }
+
+// MigrationGetLatestComplete retrieves the latest complete migration. Versions after it
+// are either pending, failed or reverted and still need to be run.
+func MigrationGetLatestComplete(db *sql.Connection, code string) (m *model.Migration, err error) {
+	status := model.MIGRATION_STATUS_COMPLETE
+	mList, _, err := MigrationGet(db, &MigrationGetParam{
+		Limit:          1,
+		Code:           &code,
+		Status:         &status,
+		OrderByVersion: "desc",
+	})
+	if err != nil {
+		// Check for table does not exist error
+		if e.IsPQError(err, e.PQErr42P01) {
+			return nil, e.N(ECode00030C, e.MsgMigrationNotInstalled)
+		}
+		return nil, e.W(err, ECode00030D)
+	}
+
+	if len(mList) != 1 {
+		return nil, e.N(ECode00030E, e.MsgMigrationNone)
+	}
+
+	return mList[0], nil
+}
+
+// MigrationGetChecksumList returns all migrations of the code, sorted by version, with
+// only their id, code, version, status and checksum set
+func MigrationGetChecksumList(db *sql.Connection,
+	code string) (mList []*model.Migration, err error) {
+	stmt := `SELECT skyrin_migration_id,skyrin_migration_code,skyrin_migration_version,
+		skyrin_migration_status,skyrin_migration_checksum
+		FROM skyrin_migration
+		WHERE skyrin_migration_code=$1
+		ORDER BY skyrin_migration_version`
+
+	rows, err := db.Query(stmt, code)
+	if err != nil {
+		return nil, e.W(err, ECode00030F, fmt.Sprintf("code: %s", code))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := &model.Migration{}
+		if err := rows.Scan(&m.ID, &m.Code, &m.Version,
+			&m.Status, &m.Checksum); err != nil {
+			return nil, e.W(err, ECode000310, fmt.Sprintf("code: %s", code))
+		}
+
+		mList = append(mList, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, e.W(err, ECode000311, fmt.Sprintf("code: %s", code))
+	}
+
+	return mList, nil
+}
+
+// MigrationStart records the start of an attempt to run the migration, incrementing its
+// attempts. It should not be in the txn running the migration, so failed attempts are
+// also counted.
+func MigrationStart(db *sql.Connection, id int, host, appVersion string) (err error) {
+	ub := db.Update(MigrationTableName).
+		Set("updated_on", "now()").
+		Set("skyrin_migration_started_on", "now()").
+		Set("skyrin_migration_finished_on", nil).
+		Set("skyrin_migration_duration_ms", nil).
+		Set("skyrin_migration_host", host).
+		Set("skyrin_migration_app_version", appVersion).
+		Set("skyrin_migration_attempts", sq.Expr("skyrin_migration_attempts+1")).
+		Where("skyrin_migration_id=?", id)
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode000312, fmt.Sprintf("params: %d, %s, %s", id, host, appVersion))
+	}
+
+	return nil
+}
+
+// MigrationGetHistory returns all migrations of the code, sorted by version, with their
+// run history. The SQL is not returned.
+func MigrationGetHistory(db *sql.Connection,
+	code string) (mList []*model.Migration, err error) {
+	stmt := `SELECT skyrin_migration_id,skyrin_migration_code,skyrin_migration_version,
+		skyrin_migration_status,skyrin_migration_err,skyrin_migration_checksum,
+		COALESCE(skyrin_migration_started_on::TEXT, ''),
+		COALESCE(skyrin_migration_finished_on::TEXT, ''),
+		COALESCE(skyrin_migration_duration_ms, 0),
+		skyrin_migration_host,skyrin_migration_app_version,skyrin_migration_attempts,
+		created_on::TEXT,updated_on::TEXT
+		FROM skyrin_migration
+		WHERE skyrin_migration_code=$1
+		ORDER BY skyrin_migration_version`
+
+	rows, err := db.Query(stmt, code)
+	if err != nil {
+		return nil, e.W(err, ECode000313, fmt.Sprintf("code: %s", code))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := &model.Migration{}
+		var durationMS int64
+		if err := rows.Scan(&m.ID, &m.Code, &m.Version,
+			&m.Status, &m.Err, &m.Checksum,
+			&m.StartedOn, &m.FinishedOn, &durationMS,
+			&m.Host, &m.AppVersion, &m.Attempts,
+			&m.CreatedOn, &m.UpdatedOn); err != nil {
+			return nil, e.W(err, ECode000314, fmt.Sprintf("code: %s", code))
+		}
+		m.Duration = time.Duration(durationMS) * time.Millisecond
+
+		mList = append(mList, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, e.W(err, ECode000315, fmt.Sprintf("code: %s", code))
+	}
+
+	return mList, nil
+}
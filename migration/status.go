@@ -0,0 +1,145 @@
+package migration
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/migration/model"
+	"github.com/Skyrin/go-lib/migration/sqlmodel"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ECode000601 = e.Code0006 + "01"
+	ECode000602 = e.Code0006 + "02"
+	ECode000603 = e.Code0006 + "03"
+	ECode000604 = e.Code0006 + "04"
+	ECode000605 = e.Code0006 + "05"
+	ECode000606 = e.Code0006 + "06"
+	ECode000607 = e.Code0006 + "07"
+	ECode000608 = e.Code0006 + "08"
+	ECode000609 = e.Code0006 + "09"
+)
+
+// ListStatus the migration status of a migration list
+type ListStatus struct {
+	Code    string
+	Version int   // The latest complete version
+	Applied []int // Complete versions
+	Pending []int // Versions that have not run yet, or were reverted
+	Failed  []int // Versions that failed, they run again on the next upgrade
+}
+
+// Status returns the migration status of all added migration lists, in the order they
+// were added
+func (m *Migrator) Status() (lsList []*ListStatus, err error) {
+	for _, ml := range m.migrations {
+		ls, err := m.getListStatus(ml)
+		if err != nil {
+			return nil, e.W(err, ECode000601)
+		}
+		lsList = append(lsList, ls)
+	}
+
+	return lsList, nil
+}
+
+// getListStatus returns the migration status of the migration list
+func (m *Migrator) getListStatus(ml *List) (ls *ListStatus, err error) {
+	fList, err := ml.GetMigrationFiles()
+	if err != nil {
+		return nil, e.W(err, ECode000602)
+	}
+
+	mList, _, err := sqlmodel.MigrationGet(m.db, &sqlmodel.MigrationGetParam{
+		Limit:          math.MaxInt32,
+		Code:           &ml.code,
+		OrderByVersion: "asc",
+	})
+	if err != nil {
+		return nil, e.W(err, ECode000603)
+	}
+
+	statusMap := make(map[int]model.MigrationStatus, len(mList))
+	for _, mm := range mList {
+		statusMap[mm.Version] = mm.Status
+	}
+
+	ls = &ListStatus{Code: ml.code}
+	for _, f := range fList {
+		switch statusMap[f.Version] {
+		case model.MIGRATION_STATUS_COMPLETE:
+			ls.Applied = append(ls.Applied, f.Version)
+			ls.Version = f.Version
+		case model.MIGRATION_STATUS_FAILED:
+			ls.Failed = append(ls.Failed, f.Version)
+		default:
+			ls.Pending = append(ls.Pending, f.Version)
+		}
+	}
+
+	return ls, nil
+}
+
+// MarkApplied marks the versions of the migration list with the code, up to and
+// including the specified version, as complete without running them. Use it to
+// baseline a database whose schema was created outside of the migrator.
+func (m *Migrator) MarkApplied(code string, version int) (err error) {
+	ml, err := m.getList(code)
+	if err != nil {
+		return e.W(err, ECode000604)
+	}
+
+	if err := m.mustLock(); err != nil {
+		return e.W(err, ECode000605)
+	}
+	defer m.unlock()
+
+	if err := m.loadListFiles(ml); err != nil {
+		return e.W(err, ECode000606)
+	}
+
+	if version <= 0 || len(ml.files) == 0 || ml.files[len(ml.files)-1].Version < version {
+		return e.N(ECode000607, fmt.Sprintf("%s: %s/%d",
+			e.MsgMigrationVersionNotFound, code, version))
+	}
+
+	for _, f := range ml.files {
+		if f.Version > version {
+			break
+		}
+
+		id, run, err := m.checkShouldRunFile(ml, f)
+		if err != nil {
+			return e.W(err, ECode000608)
+		}
+		if !run {
+			continue
+		}
+
+		status := model.MIGRATION_STATUS_COMPLETE
+		errMsg := ""
+		up := &sqlmodel.MigrationUpdateParam{
+			Status: &status,
+			Err:    &errMsg,
+		}
+		if m.useChecksum(ml, f) {
+			checksum := f.Checksum()
+			up.Checksum = &checksum
+		}
+
+		if err := sqlmodel.MigrationUpdate(m.db, id, up); err != nil {
+			return e.W(err, ECode000609)
+		}
+
+		if f.Version > ml.version {
+			ml.version = f.Version
+		}
+
+		log.Info().Str("instance", m.instance).Msgf("marked '%s' version: %v as applied",
+			ml.code, f.Version)
+	}
+
+	return nil
+}
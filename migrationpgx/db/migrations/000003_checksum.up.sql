@@ -0,0 +1,12 @@
+BEGIN;
+
+-- Adds the SHA-256 checksum of the migration's SQL, used to detect files edited after
+-- they ran. Existing migrations get the checksum of the SQL they ran with.
+ALTER TABLE skyrin_migration
+	ADD COLUMN IF NOT EXISTS skyrin_migration_checksum TEXT NOT NULL DEFAULT '';
+
+UPDATE skyrin_migration
+	SET skyrin_migration_checksum=encode(sha256(convert_to(skyrin_migration_sql, 'UTF8')), 'hex')
+	WHERE skyrin_migration_checksum='';
+
+COMMIT;
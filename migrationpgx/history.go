@@ -0,0 +1,84 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	lib "github.com/Skyrin/go-lib"
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/migrationpgx/model"
+	"github.com/Skyrin/go-lib/migrationpgx/sqlmodel"
+)
+
+const (
+	// MIGRATION_HISTORY_VERSION the version of the migrator's own migrations that adds
+	// the run history columns
+	MIGRATION_HISTORY_VERSION = 4
+
+	ECode010801 = e.Code0108 + "01"
+	ECode010802 = e.Code0108 + "02"
+	ECode010803 = e.Code0108 + "03"
+	ECode010804 = e.Code0108 + "04"
+)
+
+// History returns the migrations of the list, sorted by version, with when their latest
+// attempt started and finished, how long it took, the host and app version that ran it
+// and the number of attempts
+func (m *Migrator) History(ctx context.Context, code string) (mList []*model.Migration, err error) {
+	if _, err := m.getList(code); err != nil {
+		return nil, e.W(err, ECode010801)
+	}
+
+	if !m.hasHistory() {
+		return nil, e.N(ECode010802, "migration history is not installed, run Upgrade first")
+	}
+
+	mList, err = sqlmodel.MigrationGetHistory(ctx, m.db, code)
+	if err != nil {
+		return nil, e.W(err, ECode010803)
+	}
+
+	return mList, nil
+}
+
+// hasHistory checks if the migrator's own migrations have added the history columns
+func (m *Migrator) hasHistory() bool {
+	ml, err := m.getList(MIGRATION_CODE)
+	return err == nil && ml.version >= MIGRATION_HISTORY_VERSION
+}
+
+// useHistory checks if the duration should be saved when the file completes. Like
+// useChecksum, this is also the case for the migrator's own file that adds the columns.
+func (m *Migrator) useHistory(ml *List, f *File) bool {
+	return m.hasHistory() ||
+		(ml.code == MIGRATION_CODE && f.Version >= MIGRATION_HISTORY_VERSION)
+}
+
+// getAppVersion returns the app version recorded with each migration, the sha and build
+// set at compile time, see lib.Version
+func getAppVersion() string {
+	vList := []string{}
+	sha, build := lib.Version()
+	for _, v := range []string{sha, build} {
+		if v != "" {
+			vList = append(vList, v)
+		}
+	}
+
+	return strings.Join(vList, "/")
+}
+
+// startFile records the start of an attempt to run the file, if the history columns
+// exist. The attempt is counted even if it fails.
+func (m *Migrator) startFile(ctx context.Context, id int) (err error) {
+	if !m.hasHistory() {
+		return nil
+	}
+
+	if err := sqlmodel.MigrationStart(ctx, m.db, id, getHost(), getAppVersion()); err != nil {
+		return e.W(err, ECode010804, fmt.Sprintf("id: %d", id))
+	}
+
+	return nil
+}
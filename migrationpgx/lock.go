@@ -0,0 +1,120 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MIGRATION_LOCK_WAIT the default time to wait for the migration lock
+	MIGRATION_LOCK_WAIT = 5 * time.Minute
+	// MIGRATION_LOCK_POLL how often to retry taking the migration lock while waiting
+	MIGRATION_LOCK_POLL = time.Second
+
+	ECode010401 = e.Code0104 + "01"
+	ECode010402 = e.Code0104 + "02"
+	ECode010403 = e.Code0104 + "03"
+	ECode010404 = e.Code0104 + "04"
+	ECode010405 = e.Code0104 + "05"
+)
+
+// SetLockWait sets how long the migrator waits for the migration lock if another
+// instance holds it. If wait is 0, Upgrade does not wait and skips the upgrade
+// instead, leaving it to the instance holding the lock.
+func (m *Migrator) SetLockWait(wait time.Duration) {
+	m.lockWait = wait
+}
+
+// lock takes the Postgres advisory lock for migrations, so only one instance migrates
+// at a time. The lock is held by a dedicated connection until unlock is called. If
+// another instance holds the lock, it waits up to the lock wait, then returns false.
+func (m *Migrator) lock(ctx context.Context) (acquired bool, err error) {
+	conn, err := m.db.DB.Acquire(ctx)
+	if err != nil {
+		return false, e.W(err, ECode010401)
+	}
+
+	deadline := time.Now().Add(m.lockWait)
+	for {
+		if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`,
+			MIGRATION_TABLE).Scan(&acquired); err != nil {
+			conn.Release()
+			return false, e.W(err, ECode010402)
+		}
+
+		if acquired {
+			m.lockConn = conn
+			log.Info().Str("instance", m.instance).Msg("acquired migration lock")
+			return true, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			conn.Release()
+			return false, nil
+		}
+
+		log.Info().Str("instance", m.instance).
+			Msg("waiting for migration lock held by another instance")
+
+		select {
+		case <-ctx.Done():
+			conn.Release()
+			return false, e.W(ctx.Err(), ECode010403)
+		case <-time.After(MIGRATION_LOCK_POLL):
+		}
+	}
+}
+
+// mustLock takes the migration lock, returning an error if it could not be acquired
+func (m *Migrator) mustLock(ctx context.Context) (err error) {
+	acquired, err := m.lock(ctx)
+	if err != nil {
+		return e.W(err, ECode010404)
+	}
+
+	if !acquired {
+		return e.N(ECode010405, e.MsgMigrationLocked)
+	}
+
+	return nil
+}
+
+// unlock releases the migration lock. If releasing fails, the connection holding the
+// lock is closed instead of returned to the pool, which also releases it.
+func (m *Migrator) unlock(ctx context.Context) {
+	if m.lockConn == nil {
+		return
+	}
+
+	conn := m.lockConn
+	m.lockConn = nil
+
+	// Use a separate context, so the lock is released even if ctx was cancelled
+	if _, err := conn.Exec(context.Background(),
+		`SELECT pg_advisory_unlock(hashtext($1))`, MIGRATION_TABLE); err != nil {
+		log.Error().Err(err).Str("instance", m.instance).Msg("[Migrator.unlock]")
+		_ = conn.Conn().Close(ctx)
+	}
+
+	conn.Release()
+}
+
+// getInstance returns the name of this instance, used to log which instance migrated
+func getInstance() string {
+	return fmt.Sprintf("%s:%d", getHost(), os.Getpid())
+}
+
+// getHost returns the host name, or unknown if it can not be determined
+func getHost() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+
+	return host
+}
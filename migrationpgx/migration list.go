@@ -1,40 +1,81 @@
 package migration
 
 import (
-	"embed"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 
 	"github.com/Skyrin/go-lib/e"
+	sql "github.com/Skyrin/go-lib/sqlpgx"
 )
 
 const (
+	// MIGRATION_NO_TRANSACTION header directive to run a file outside of a txn, needed
+	// for statements like CREATE INDEX CONCURRENTLY. It must be in the comments at the
+	// top of the file, before the first statement.
+	MIGRATION_NO_TRANSACTION = "-- migrate:no-transaction"
+	// MIGRATION_LOCK_TIMEOUT_DIRECTIVE header directive to run a no-transaction file with
+	// the lock timeout. Without it, the lock timeout is not set for no-transaction files,
+	// as statements like CREATE INDEX CONCURRENTLY wait on locks by design.
+	MIGRATION_LOCK_TIMEOUT_DIRECTIVE = "-- migrate:lock-timeout"
+
 	ECode010201 = e.Code0102 + "01"
 	ECode010202 = e.Code0102 + "02"
 	ECode010203 = e.Code0102 + "03"
 	ECode010204 = e.Code0102 + "04"
 	ECode010205 = e.Code0102 + "05"
 	ECode010206 = e.Code0102 + "06"
+	ECode010207 = e.Code0102 + "07"
+	ECode010208 = e.Code0102 + "08"
+	ECode01020A = e.Code0102 + "0A"
+	ECode01020B = e.Code0102 + "0B"
+	ECode01020C = e.Code0102 + "0C"
 )
 
 type File struct {
 	Name    string
 	Version int
 	SQL     []byte
+	DownSQL []byte // SQL of the paired down file, if any, used to revert the version
+	// Func the Go func of a func migration, see List.AddFunc. If set, it runs instead of the SQL
+	Func func(ctx context.Context, tx *sql.Connection) error
 }
 
 type List struct {
 	code       string
 	path       string
-	migrations embed.FS
+	migrations fs.FS
 	files      []*File
 	new        bool
+	version    int // The latest complete version
+	funcs      []*File
+	dependList []*dependency
+	vars       *TemplateVars
 	// GetMigrations() (string, embed.FS)
 }
 
-// NewList initialize a new list
-func NewList(code, path string, migrations embed.FS) (l *List) {
+// TemplateVars variables used to render a list's SQL files as text/template templates,
+// e.g. {{.Schema}}, so the same migrations can install into different schemas
+type TemplateVars struct {
+	Schema     string
+	Tablespace string
+	Role       string
+	Vars       map[string]interface{} // Any other variables, e.g. {{.Vars.owner}}
+}
+
+// NewList initialize a new list. The migrations can be any file system, usually an
+// embed.FS, with the files in the path directory.
+func NewList(code, path string, migrations fs.FS) (l *List) {
 	return &List{
 		code:       code,
 		path:       path,
@@ -42,6 +83,37 @@ func NewList(code, path string, migrations embed.FS) (l *List) {
 	}
 }
 
+// NewDirList initializes a new list with the files in a directory on disk, e.g. to
+// work on migrations locally without rebuilding
+func NewDirList(code, dir string) (l *List) {
+	return NewList(code, ".", os.DirFS(dir))
+}
+
+// SetTemplateVars enables rendering the list's SQL files, up and down, as
+// text/template templates with the variables before they run. Checksums are of the
+// rendered SQL.
+func (l *List) SetTemplateVars(vars *TemplateVars) *List {
+	l.vars = vars
+	return l
+}
+
+// AddFunc adds a Go func migration, for data migrations that need Go logic. It runs
+// with the SQL files, in version order, in a txn along with the update of its
+// migration status. The tx passed to it is in that txn. The version must not be used by
+// a SQL file, but a down file with the version can revert it. Only the name is
+// checksummed, so edits to the func are not detected by Verify.
+func (l *List) AddFunc(version int, name string, f func(ctx context.Context, tx *sql.Connection) error) *List {
+	fileSQL := fmt.Sprintf("-- go func: %s", name)
+	l.funcs = append(l.funcs, &File{
+		Name:    fmt.Sprintf("%06d_%s.go", version, name),
+		Version: version,
+		SQL:     []byte(fileSQL),
+		Func:    f,
+	})
+
+	return l
+}
+
 // GetVersionFromName parse the name for the version. The name is expected to have
 // the version first as a 0 padded number and then an underscore. The rest of the
 // name can be anything.
@@ -67,19 +139,122 @@ func (f *File) GetVersionFromName() (v int, err error) {
 	return v, nil
 }
 
-// GetLatestMigrationFiles gets all migration files after the specified version from
-// the migration list's embeded file system
-func (l List) GetLatestMigrationFiles(v int) (fList []*File, err error) {
+// Checksum returns the hex encoded SHA-256 checksum of the file's SQL
+func (f *File) Checksum() string {
+	sum := sha256.Sum256(f.SQL)
+	return hex.EncodeToString(sum[:])
+}
+
+// IsDown checks if the file is a down migration, i.e. its name ends with .down.sql
+func (f *File) IsDown() bool {
+	return strings.HasSuffix(f.Name, ".down.sql")
+}
+
+// getHeaderLines returns the comment lines at the top of the SQL, before the first
+// statement
+func getHeaderLines(fileSQL []byte) (lineList []string) {
+	for _, line := range strings.Split(string(fileSQL), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+
+		lineList = append(lineList, line)
+	}
+
+	return lineList
+}
+
+// hasNoTransactionDirective checks if the SQL has the no-transaction header directive
+func hasNoTransactionDirective(fileSQL []byte) bool {
+	return hasHeaderDirective(fileSQL, MIGRATION_NO_TRANSACTION)
+}
+
+// hasLockTimeoutDirective checks if the SQL has the lock timeout header directive
+func hasLockTimeoutDirective(fileSQL []byte) bool {
+	return hasHeaderDirective(fileSQL, MIGRATION_LOCK_TIMEOUT_DIRECTIVE)
+}
+
+// hasHeaderDirective checks if the SQL has the directive in its header
+func hasHeaderDirective(fileSQL []byte, directive string) bool {
+	for _, line := range getHeaderLines(fileSQL) {
+		if strings.EqualFold(line, directive) {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	// Match the statement starting the first line and ending the last line of the SQL
+	txnBeginRegex  = regexp.MustCompile(`(?i)^(BEGIN(\s+(TRANSACTION|WORK))?|START\s+TRANSACTION)\s*;`)
+	txnCommitRegex = regexp.MustCompile(`(?i)(^|;)\s*(COMMIT|END)(\s+(TRANSACTION|WORK))?\s*;$`)
+)
+
+// stripTransaction removes the BEGIN; (or START TRANSACTION;) and COMMIT; (or END;)
+// statements wrapping the SQL, if it has both, so it can run in the migrator's txn along
+// with the status update. The statements do not have to be on their own lines, e.g.
+// BEGIN; CREATE TABLE ...; COMMIT; is stripped too. Files that do not wrap their SQL in a
+// txn are returned as is.
+func stripTransaction(fileSQL []byte) []byte {
+	lineList := strings.Split(string(fileSQL), "\n")
+	first, last := -1, -1
+	for i, line := range lineList {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+
+		if first == -1 {
+			first = i
+		}
+		last = i
+	}
+
+	if first == -1 {
+		return fileSQL
+	}
+
+	firstLine := strings.TrimSpace(lineList[first])
+	loc := txnBeginRegex.FindStringIndex(firstLine)
+	if loc == nil {
+		return fileSQL
+	}
+	lineList[first] = strings.TrimSpace(firstLine[loc[1]:])
+
+	// The first and last line are the same if the whole SQL is on one line
+	lastLine := strings.TrimSpace(lineList[last])
+	if !txnCommitRegex.MatchString(lastLine) {
+		return fileSQL
+	}
+	lineList[last] = txnCommitRegex.ReplaceAllString(lastLine, "$1")
+
+	return []byte(strings.Join(lineList, "\n"))
+}
 
-	dirList, err := l.migrations.ReadDir(l.path)
+// GetMigrationFiles gets all migration (*.sql) files from the migration list's file
+// system, sorted by version ascending. Down files (*.down.sql) are not returned on
+// their own, their SQL is set as the DownSQL of the file with the same version. The
+// files are validated, returning a single error with all problems found: names that
+// do not parse, duplicate versions, down files without an up file and gaps between
+// versions, which must start at 1.
+func (l List) GetMigrationFiles() (fList []*File, err error) {
+	dirList, err := fs.ReadDir(l.migrations, l.path)
 	if err != nil {
 		return nil, e.W(err, ECode010204)
 	}
 	fList = make([]*File, 0, len(dirList))
+	downList := make([]*File, 0)
+	problemList := []string{}
 
 	// Load files first, then sort according to version
 	for _, file := range dirList {
-		if file.IsDir() {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".sql") {
 			continue
 		}
 		// Get version
@@ -87,35 +262,135 @@ func (l List) GetLatestMigrationFiles(v int) (fList []*File, err error) {
 			Name: file.Name(),
 		}
 
-		embededFilePath := strings.Join([]string{
-			l.path,
-			file.Name(),
-		}, "/")
+		embededFilePath := path.Join(l.path, file.Name())
 
 		f.Version, err = f.GetVersionFromName()
 		if err != nil {
-			return nil, e.W(err, ECode010205)
-		}
-
-		// TODO: ensure incremental versions?
-		// If the file version is less than the get from version, then move to the next one
-		if f.Version < v {
+			problemList = append(problemList,
+				fmt.Sprintf("%s: %s", f.Name, e.MsgMigrationFileNameInvalid))
 			continue
 		}
 
-		// Should be a file we are looking for
-		f.SQL, err = l.migrations.ReadFile(embededFilePath)
+		f.SQL, err = fs.ReadFile(l.migrations, embededFilePath)
 		if err != nil {
 			return nil, e.W(err, ECode010206)
 		}
 
+		if l.vars != nil {
+			f.SQL, err = l.render(f.Name, f.SQL)
+			if err != nil {
+				return nil, e.W(err, ECode01020A)
+			}
+		}
+
+		if f.IsDown() {
+			downList = append(downList, f)
+			continue
+		}
+
 		fList = append(fList, f)
 	}
+	fList = append(fList, l.funcs...)
 
 	// Sort files by version ascending
-	sort.Slice(fList, func(i, j int) bool {
+	sort.SliceStable(fList, func(i, j int) bool {
 		return fList[i].Version < fList[j].Version
 	})
+	sort.SliceStable(downList, func(i, j int) bool {
+		return downList[i].Version < downList[j].Version
+	})
+
+	for i, f := range fList {
+		switch {
+		case i > 0 && f.Version == fList[i-1].Version:
+			problemList = append(problemList, fmt.Sprintf("%s: %s, version %d also in %s",
+				f.Name, e.MsgMigrationVersionDuplicate, f.Version, fList[i-1].Name))
+		case i == 0 && f.Version != 1:
+			problemList = append(problemList, fmt.Sprintf("%s: %s, versions 1-%d missing",
+				f.Name, e.MsgMigrationVersionGap, f.Version-1))
+		case i > 0 && f.Version > fList[i-1].Version+1:
+			problemList = append(problemList, fmt.Sprintf("%s: %s, versions %d-%d missing",
+				f.Name, e.MsgMigrationVersionGap, fList[i-1].Version+1, f.Version-1))
+		}
+	}
+
+	// Pair the down files with their up file
+	for i, down := range downList {
+		if i > 0 && down.Version == downList[i-1].Version {
+			problemList = append(problemList, fmt.Sprintf("%s: %s, version %d also in %s",
+				down.Name, e.MsgMigrationVersionDuplicate, down.Version, downList[i-1].Name))
+			continue
+		}
+
+		found := false
+		for _, f := range fList {
+			if f.Version == down.Version {
+				f.DownSQL = down.SQL
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			problemList = append(problemList,
+				fmt.Sprintf("%s: %s", down.Name, e.MsgMigrationDownWithoutUp))
+		}
+	}
+
+	if len(problemList) > 0 {
+		return nil, e.N(ECode010205, fmt.Sprintf("%s '%s': %s",
+			e.MsgMigrationListInvalid, l.code, strings.Join(problemList, "; ")))
+	}
 
 	return fList, nil
 }
+
+// Lint validates the migration list, returning an error with all problems found, see
+// GetMigrationFiles. Use it in the unit tests of packages that define migrations:
+//
+//	if err := migration.Lint(GetMigrationList()); err != nil {
+//		t.Fatal(err)
+//	}
+func Lint(l *List) (err error) {
+	if _, err := l.GetMigrationFiles(); err != nil {
+		return e.W(err, ECode010207)
+	}
+
+	return nil
+}
+
+// GetLatestMigrationFiles gets all migration files from the specified version onwards
+// from the migration list's file system
+func (l List) GetLatestMigrationFiles(v int) (fList []*File, err error) {
+	allList, err := l.GetMigrationFiles()
+	if err != nil {
+		return nil, e.W(err, ECode010208)
+	}
+
+	fList = make([]*File, 0, len(allList))
+	for _, f := range allList {
+		// If the file version is less than the get from version, then move to the next one
+		if f.Version < v {
+			continue
+		}
+
+		fList = append(fList, f)
+	}
+
+	return fList, nil
+}
+
+// render renders the SQL as a text/template template with the list's variables
+func (l List) render(name string, fileSQL []byte) (rendered []byte, err error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(string(fileSQL))
+	if err != nil {
+		return nil, e.W(err, ECode01020B, name)
+	}
+
+	buf := bytes.Buffer{}
+	if err := t.Execute(&buf, l.vars); err != nil {
+		return nil, e.W(err, ECode01020C, name)
+	}
+
+	return buf.Bytes(), nil
+}
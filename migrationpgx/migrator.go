@@ -6,6 +6,34 @@
 // _ = migrator.AddMigrationList(arc.GetMigrationList()) // See below
 // _ = migrator.Upgrade()
 //
+// Detect migration files edited after they ran, refusing to upgrade if strict
+// driftList, _ := migrator.Verify()
+// migrator.SetStrict(true)
+//
+// Stage a rollout or recover from a bad deploy, the versions being reverted need a
+// paired down file, e.g. 000003_add_column.up.sql and 000003_add_column.down.sql
+// _ = migrator.UpgradeTo("arc", 3)
+// _ = migrator.Downgrade("arc", 2)
+//
+// When each version ran, how long it took and which host and app version ran it
+// mList, _ := migrator.History("arc")
+//
+// Data migrations that need Go logic can be added to a list as funcs, see List.AddFunc
+// ml.AddFunc(3, "rehash_tokens", func(ctx context.Context, tx *sql.Connection) error { ... })
+//
+// Pending files are checked for SQL that takes long locks on existing tables, e.g.
+// CREATE INDEX without CONCURRENTLY, and run with a lock_timeout, see SetSafety
+// migrator.SetSafety(migration.SafetyBlock)
+//
+// Each file runs in a txn along with the update of its migration status. A file that
+// can not run in a txn, e.g. CREATE INDEX CONCURRENTLY, needs the header directive:
+// -- migrate:no-transaction
+//
+// A no-transaction file runs without the lock_timeout, as CREATE INDEX CONCURRENTLY waits
+// for the transactions using the table by design. To run it with the lock_timeout anyway,
+// add the header directive:
+// -- migrate:lock-timeout
+//
 // Example package that defines migrations
 // var migrations embed.FS
 //
@@ -25,11 +53,15 @@ package migration
 import (
 	"context"
 	"embed"
+	"fmt"
+	"math"
+	"time"
 
 	"github.com/Skyrin/go-lib/e"
 	"github.com/Skyrin/go-lib/migrationpgx/model"
 	"github.com/Skyrin/go-lib/migrationpgx/sqlmodel"
 	sql "github.com/Skyrin/go-lib/sqlpgx"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog/log"
 )
 
@@ -59,18 +91,67 @@ const (
 	ECode01010D = e.Code0101 + "0D"
 	ECode01010E = e.Code0101 + "0E"
 	ECode01010F = e.Code0101 + "0F"
+	ECode010110 = e.Code0101 + "10"
+	ECode010111 = e.Code0101 + "11"
+	ECode010112 = e.Code0101 + "12"
+	ECode010113 = e.Code0101 + "13"
+	ECode010114 = e.Code0101 + "14"
+	ECode010115 = e.Code0101 + "15"
+	ECode010116 = e.Code0101 + "16"
+	ECode010117 = e.Code0101 + "17"
+	ECode010118 = e.Code0101 + "18"
+	ECode010119 = e.Code0101 + "19"
+	ECode01011A = e.Code0101 + "1A"
+	ECode01011B = e.Code0101 + "1B"
+	ECode01011C = e.Code0101 + "1C"
+	ECode01011D = e.Code0101 + "1D"
+	ECode01011E = e.Code0101 + "1E"
+	ECode01011F = e.Code0101 + "1F"
+	ECode010120 = e.Code0101 + "20"
+	ECode010121 = e.Code0101 + "21"
+	ECode010122 = e.Code0101 + "22"
+	ECode010123 = e.Code0101 + "23"
+	ECode010124 = e.Code0101 + "24"
+	ECode010125 = e.Code0101 + "25"
+	ECode010126 = e.Code0101 + "26"
+	ECode010127 = e.Code0101 + "27"
+	ECode010128 = e.Code0101 + "28"
+	ECode010129 = e.Code0101 + "29"
+	ECode01012A = e.Code0101 + "2A"
+	ECode01012B = e.Code0101 + "2B"
+	ECode01012C = e.Code0101 + "2C"
+	ECode01012D = e.Code0101 + "2D"
+	ECode01012E = e.Code0101 + "2E"
+	ECode01012F = e.Code0101 + "2F"
+	ECode010130 = e.Code0101 + "30"
+	ECode010131 = e.Code0101 + "31"
+	ECode010132 = e.Code0101 + "32"
+	ECode010133 = e.Code0101 + "33"
+	ECode010134 = e.Code0101 + "34"
+	ECode010135 = e.Code0101 + "35"
 )
 
 type Migrator struct {
 	db         *sql.Connection
 	latest     *model.Migration
 	migrations []*List
+	instance   string // Name of this instance, logged when migrating
+	lockWait   time.Duration
+	lockConn   *pgxpool.Conn // Connection holding the migration lock
+	strict     bool          // Refuse to upgrade if there is drift, see Verify
+	safety     SafetyMode    // How unsafe pending SQL is handled, see SetSafety
+	// lock_timeout while running migration files, see SetLockTimeout
+	lockTimeout time.Duration
 }
 
 // NewMigrator initializes a new migrator
 func NewMigrator(ctx context.Context, db *sql.Connection) (m *Migrator, err error) {
 	m = &Migrator{
-		db: db,
+		db:          db,
+		instance:    getInstance(),
+		lockWait:    MIGRATION_LOCK_WAIT,
+		safety:      SafetyWarn,
+		lockTimeout: MIGRATION_LOCK_TIMEOUT,
 	}
 
 	// The migrator will always append it's own migration first
@@ -98,13 +179,24 @@ func NewMigrator(ctx context.Context, db *sql.Connection) (m *Migrator, err erro
 
 // AddMigrationList adds a migration list to the migrator
 func (m *Migrator) AddMigrationList(ctx context.Context, ml *List) (err error) {
-	mm, err := sqlmodel.MigrationGetLatest(ctx, m.db, ml.code)
+	if err := m.loadListFiles(ctx, ml); err != nil {
+		return e.W(err, ECode010104)
+	}
+
+	m.migrations = append(m.migrations, ml)
+	return nil
+}
+
+// loadListFiles loads the list's files that may still need to run, i.e. from the latest
+// complete version onwards
+func (m *Migrator) loadListFiles(ctx context.Context, ml *List) (err error) {
+	mm, err := sqlmodel.MigrationGetLatestComplete(ctx, m.db, ml.code)
 	if err != nil {
 		// If the migrations library has not been installed or there are no
 		// migrations for the specified code yet, then return a place holder
 		// Otherwise, return the error now
 		if !e.ContainsError(err, e.MsgMigrationNone) { // && !e.ContainsError(err, e.MsgMigrationDoesNotExist) {
-			return e.W(err, ECode010104)
+			return e.W(err, ECode010110)
 		}
 
 		// If no migrations exist, then this is a brand new installation
@@ -126,15 +218,42 @@ func (m *Migrator) AddMigrationList(ctx context.Context, ml *List) (err error) {
 	if err != nil {
 		return e.W(err, ECode010105)
 	}
+	ml.version = mm.Version
+
+	return nil
+}
+
+// reloadListFiles reloads the files of all migration lists
+func (m *Migrator) reloadListFiles(ctx context.Context) (err error) {
+	for _, ml := range m.migrations {
+		if err := m.loadListFiles(ctx, ml); err != nil {
+			return e.W(err, ECode010125)
+		}
+	}
 
-	m.migrations = append(m.migrations, ml)
 	return nil
 }
 
+// getList returns the added migration list with the code
+func (m *Migrator) getList(code string) (ml *List, err error) {
+	for _, ml := range m.migrations {
+		if ml.code == code {
+			return ml, nil
+		}
+	}
+
+	return nil, e.N(ECode010111, fmt.Sprintf("%s: %s", e.MsgMigrationListNotFound, code))
+}
+
 // install installs the migrator, it will only run the first migration and should only be called
 // once. NewMigrator logic handles when to call the installation.
 func (m *Migrator) install(ctx context.Context, ml *List) (err error) {
-	// TODO: grab a lock on the DB so no other migrations will run (they should wait)
+	// Another instance may be installing at the same time, the install SQL is
+	// idempotent, so it is safe to run again once the lock is acquired
+	if err := m.mustLock(ctx); err != nil {
+		return e.W(err, ECode01011F)
+	}
+	defer m.unlock(ctx)
 
 	files, err := ml.GetLatestMigrationFiles(0)
 	if err != nil {
@@ -153,26 +272,190 @@ func (m *Migrator) install(ctx context.Context, ml *List) (err error) {
 	return nil
 }
 
-// Upgrade runs upgrades on all migration lists
+// Upgrade runs upgrades on all migration lists, each after the lists it depends on, see
+// List.DependsOn. It takes the migration lock first, so
+// only one instance migrates at a time. If the lock wait is 0 and another instance
+// holds the lock, the upgrade is skipped.
 func (m *Migrator) Upgrade(ctx context.Context) (err error) {
-	// TODO: grab a lock on the DB so no other migrations will run (they should wait)
+	acquired, err := m.lock(ctx)
+	if err != nil {
+		return e.W(err, ECode010120)
+	}
 
-	for _, ml := range m.migrations {
-		for _, f := range ml.files {
-			// Check if this file should be run or not
-			id, run, err := m.checkShouldRunFile(ctx, ml, f)
-			if err != nil {
-				return e.W(err, ECode010109)
-			}
-			if !run {
-				// If it shouldn't run, then skip it
-				continue
-			}
+	if !acquired {
+		log.Info().Str("instance", m.instance).
+			Msg("migration lock held by another instance, skipping upgrade")
+		return nil
+	}
+	defer m.unlock(ctx)
+
+	// Another instance may have migrated while waiting for the lock
+	if err := m.reloadListFiles(ctx); err != nil {
+		return e.W(err, ECode010121)
+	}
+
+	if err := m.checkDrift(ctx); err != nil {
+		return e.W(err, ECode01012A)
+	}
 
-			if err := m.processFile(ctx, id, ml, f); err != nil {
-				return e.W(err, ECode01010A)
+	mlList, err := m.getUpgradeOrder()
+	if err != nil {
+		return e.W(err, ECode01012D)
+	}
+
+	if err := m.checkSafety(mlList, 0); err != nil {
+		return e.W(err, ECode010133)
+	}
+
+	for _, ml := range mlList {
+		if err := m.checkDependencies(ml); err != nil {
+			return e.W(err, ECode01012E)
+		}
+
+		if err := m.upgradeList(ctx, ml, 0); err != nil {
+			return e.W(err, ECode010112)
+		}
+	}
+
+	return nil
+}
+
+// UpgradeTo runs the upgrades of the migration list with the code, up to and including
+// the specified version, or all of them if the version is 0. Other migration lists are
+// not upgraded.
+func (m *Migrator) UpgradeTo(ctx context.Context, code string, version int) (err error) {
+	ml, err := m.getList(code)
+	if err != nil {
+		return e.W(err, ECode010113)
+	}
+
+	if err := m.mustLock(ctx); err != nil {
+		return e.W(err, ECode010122)
+	}
+	defer m.unlock(ctx)
+
+	if err := m.loadListFiles(ctx, ml); err != nil {
+		return e.W(err, ECode010123)
+	}
+
+	if err := m.checkDrift(ctx); err != nil {
+		return e.W(err, ECode01012B)
+	}
+
+	if version > 0 && (len(ml.files) == 0 || ml.files[len(ml.files)-1].Version < version) {
+		return e.N(ECode010114, fmt.Sprintf("%s: %s/%d",
+			e.MsgMigrationVersionNotFound, code, version))
+	}
+
+	if _, err := m.getUpgradeOrder(); err != nil {
+		return e.W(err, ECode01012F)
+	}
+
+	if err := m.checkDependencies(ml); err != nil {
+		return e.W(err, ECode010130)
+	}
+
+	if err := m.checkSafety([]*List{ml}, version); err != nil {
+		return e.W(err, ECode010134)
+	}
+
+	if err := m.upgradeList(ctx, ml, version); err != nil {
+		return e.W(err, ECode010115)
+	}
+
+	return nil
+}
+
+// upgradeList runs the upgrades of the migration list, up to and including the max
+// version. If the max version is 0, all upgrades are run.
+func (m *Migrator) upgradeList(ctx context.Context, ml *List, maxVersion int) (err error) {
+	for _, f := range ml.files {
+		if maxVersion > 0 && f.Version > maxVersion {
+			break
+		}
+
+		// Check if this file should be run or not
+		id, run, err := m.checkShouldRunFile(ctx, ml, f)
+		if err != nil {
+			return e.W(err, ECode010109)
+		}
+		if !run {
+			// If it shouldn't run, then skip it
+			continue
+		}
+
+		if err := m.processFile(ctx, id, ml, f); err != nil {
+			return e.W(err, ECode01010A)
+		}
+	}
+
+	return nil
+}
+
+// Downgrade reverts the complete versions of the migration list with the code that are
+// after the target version, in reverse order, by running their down files. Each
+// reverted version's status is set to reverted, so a later upgrade runs it again. All
+// versions being reverted must have a down file, otherwise nothing is reverted. If a
+// down file fails, the error is recorded and its version stays complete, so the
+// downgrade can be retried.
+func (m *Migrator) Downgrade(ctx context.Context, code string, targetVersion int) (err error) {
+	ml, err := m.getList(code)
+	if err != nil {
+		return e.W(err, ECode010116)
+	}
+
+	if err := m.mustLock(ctx); err != nil {
+		return e.W(err, ECode010124)
+	}
+	defer m.unlock(ctx)
+
+	if err := m.checkDependents(ml, targetVersion); err != nil {
+		return e.W(err, ECode010131)
+	}
+
+	fList, err := ml.GetMigrationFiles()
+	if err != nil {
+		return e.W(err, ECode010117)
+	}
+
+	minVersion := targetVersion + 1
+	status := model.MIGRATION_STATUS_COMPLETE
+	mList, _, err := sqlmodel.MigrationGet(ctx, m.db, &sqlmodel.MigrationGetParam{
+		Limit:          math.MaxInt32,
+		Code:           &code,
+		MinVersion:     &minVersion,
+		Status:         &status,
+		OrderByVersion: "desc",
+	})
+	if err != nil {
+		return e.W(err, ECode010118)
+	}
+
+	// Ensure all versions can be reverted before reverting any of them
+	revertList := make([]*File, len(mList))
+	for i, mm := range mList {
+		for _, f := range fList {
+			if f.Version == mm.Version {
+				revertList[i] = f
+				break
 			}
 		}
+
+		if revertList[i] == nil || len(revertList[i].DownSQL) == 0 {
+			return e.N(ECode010119, fmt.Sprintf("%s: %s/%d",
+				e.MsgMigrationDownMissing, code, mm.Version))
+		}
+	}
+
+	for i, f := range revertList {
+		if err := m.revertFile(ctx, mList[i].ID, ml, f); err != nil {
+			return e.W(err, ECode01011A)
+		}
+	}
+
+	// Reload the files, so the reverted versions run again on the next upgrade
+	if err := m.loadListFiles(ctx, ml); err != nil {
+		return e.W(err, ECode01011B)
 	}
 
 	return nil
@@ -180,7 +463,7 @@ func (m *Migrator) Upgrade(ctx context.Context) (err error) {
 
 // checkShouldRunFile verifies if the file should be processed or not. It will retrieve the
 // associated migration record (code/version) from the skyrin_migration table. If it does not exist,
-// then it will indicate to proceed. If the status is pending/failed it will also indicate to
+// then it will indicate to proceed. If the status is pending/failed/reverted it will also indicate to
 // proceed. Otherwise, the status should be completed and it will indicate not to proceed.
 // It will also return the id of the record.
 func (m *Migrator) checkShouldRunFile(ctx context.Context, ml *List,
@@ -213,8 +496,9 @@ func (m *Migrator) checkShouldRunFile(ctx context.Context, ml *List,
 		return id, false, nil
 	}
 
-	if mm != nil && mm.Status == model.MIGRATION_STATUS_FAILED {
-		// If this version failed, then resave the SQL as it may have changed
+	if mm != nil && (mm.Status == model.MIGRATION_STATUS_FAILED ||
+		mm.Status == model.MIGRATION_STATUS_REVERTED) {
+		// If this version failed or was reverted, then resave the SQL as it may have changed
 		newSQL := string(f.SQL)
 		sqlmodel.MigrationUpdate(ctx, m.db, id, &sqlmodel.MigrationUpdateParam{
 			SQL: &newSQL,
@@ -226,31 +510,130 @@ func (m *Migrator) checkShouldRunFile(ctx context.Context, ml *List,
 
 // processFile attempts to run the migration file
 func (m *Migrator) processFile(ctx context.Context, id int, ml *List, f *File) (err error) {
-	// TODO: begin/commit/rollback?
-	var status, errMsg string
-	if _, err := m.db.Exec(ctx, string(f.SQL)); err != nil {
-		status = model.MIGRATION_STATUS_FAILED
-		errMsg = err.Error()
-		if err2 := sqlmodel.MigrationUpdate(ctx, m.db, id, &sqlmodel.MigrationUpdateParam{
+	if err := m.startFile(ctx, id); err != nil {
+		return e.W(err, ECode010132)
+	}
+	start := time.Now()
+
+	status := model.MIGRATION_STATUS_COMPLETE
+	up := &sqlmodel.MigrationUpdateParam{
+		Status: &status,
+	}
+	if m.useChecksum(ml, f) {
+		checksum := f.Checksum()
+		up.Checksum = &checksum
+	}
+	if m.useHistory(ml, f) {
+		up.Duration = new(time.Duration)
+	}
+
+	if err := m.execFile(ctx, id, f.SQL, f.Func, up); err != nil {
+		status := model.MIGRATION_STATUS_FAILED
+		errMsg := err.Error()
+		failUP := &sqlmodel.MigrationUpdateParam{
 			Status: &status,
 			Err:    &errMsg,
-		}); err2 != nil {
+		}
+		if m.hasHistory() {
+			duration := time.Since(start)
+			failUP.Duration = &duration
+		}
+		if err2 := sqlmodel.MigrationUpdate(ctx, m.db, id, failUP); err2 != nil {
 			return e.W(err, ECode01010D)
 		}
 		return e.W(err, ECode01010E)
 	}
 
-	status = model.MIGRATION_STATUS_COMPLETE
-	errMsg = ""
-	if err := sqlmodel.MigrationUpdate(ctx, m.db, id, &sqlmodel.MigrationUpdateParam{
+	if f.Version > ml.version {
+		ml.version = f.Version
+	}
+
+	log.Info().Str("instance", m.instance).Msgf("successfully migrated '%s' to version: %v",
+		ml.code, f.Version)
+
+	return nil
+}
+
+// revertFile attempts to run the down file of the migration
+func (m *Migrator) revertFile(ctx context.Context, id int, ml *List, f *File) (err error) {
+	status := model.MIGRATION_STATUS_REVERTED
+	if err := m.execFile(ctx, id, f.DownSQL, nil, &sqlmodel.MigrationUpdateParam{
 		Status: &status,
-		Err:    &errMsg,
 	}); err != nil {
-		return e.W(err, ECode01010F)
+		errMsg := err.Error()
+		if err2 := sqlmodel.MigrationUpdate(ctx, m.db, id, &sqlmodel.MigrationUpdateParam{
+			Err: &errMsg,
+		}); err2 != nil {
+			return e.W(err, ECode01011C)
+		}
+		return e.W(err, ECode01011D)
 	}
 
-	log.Info().Msgf("successfully migrated '%s' to version: %v",
+	log.Info().Str("instance", m.instance).Msgf("successfully reverted '%s' version: %v",
 		ml.code, f.Version)
 
 	return nil
 }
+
+// execFile runs the SQL, or the func if set, and applies the update, e.g. the
+// migration's status and checksum, in one txn, so the status always matches the applied
+// SQL. If the update has a duration, it is set to the time the SQL took. If the SQL has
+// the no-transaction directive, it is run as is, followed by the update. On failure,
+// nothing is recorded, that is left to the caller.
+func (m *Migrator) execFile(ctx context.Context, id int, fileSQL []byte, fileFunc func(ctx context.Context, tx *sql.Connection) error,
+	up *sqlmodel.MigrationUpdateParam) (err error) {
+	errMsg := ""
+	up.Err = &errMsg
+	start := time.Now()
+
+	if fileFunc == nil && hasNoTransactionDirective(fileSQL) {
+		if err := m.execNoTransaction(ctx, fileSQL); err != nil {
+			return e.W(err, ECode01010F)
+		}
+		setDuration(up, start)
+
+		if err := sqlmodel.MigrationUpdate(ctx, m.db, id, up); err != nil {
+			return e.W(err, ECode01011E)
+		}
+
+		return nil
+	}
+
+	db, err := m.db.BeginReturnDB(ctx)
+	if err != nil {
+		return e.W(err, ECode010126)
+	}
+	defer db.RollbackIfInTxn(ctx)
+
+	if m.lockTimeout > 0 {
+		if _, err := db.Exec(ctx, getLockTimeoutSQL("SET LOCAL", m.lockTimeout)); err != nil {
+			return e.W(err, ECode010135)
+		}
+	}
+
+	if fileFunc != nil {
+		if err := fileFunc(ctx, db); err != nil {
+			return e.W(err, ECode01012C)
+		}
+	} else if _, err := db.Exec(ctx, string(stripTransaction(fileSQL))); err != nil {
+		return e.W(err, ECode010127)
+	}
+	setDuration(up, start)
+
+	if err := sqlmodel.MigrationUpdate(ctx, db, id, up); err != nil {
+		return e.W(err, ECode010128)
+	}
+
+	if err := db.Commit(ctx); err != nil {
+		return e.W(err, ECode010129)
+	}
+
+	return nil
+}
+
+// setDuration sets the duration of the update, if it has one, to the time since start
+func setDuration(up *sqlmodel.MigrationUpdateParam, start time.Time) {
+	if up.Duration != nil {
+		*up.Duration = time.Since(start)
+	}
+}
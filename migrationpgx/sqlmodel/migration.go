@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	"github.com/Skyrin/go-lib/e"
 	"github.com/Skyrin/go-lib/migrationpgx/model"
 	sql "github.com/Skyrin/go-lib/sqlpgx"
@@ -25,6 +27,16 @@ const (
 	ECode010309 = e.Code0103 + "09"
 	ECode01030A = e.Code0103 + "0A"
 	ECode01030B = e.Code0103 + "0B"
+	ECode01030C = e.Code0103 + "0C"
+	ECode01030D = e.Code0103 + "0D"
+	ECode01030E = e.Code0103 + "0E"
+	ECode01030F = e.Code0103 + "0F"
+	ECode010310 = e.Code0103 + "10"
+	ECode010311 = e.Code0103 + "11"
+	ECode010312 = e.Code0103 + "12"
+	ECode010313 = e.Code0103 + "13"
+	ECode010314 = e.Code0103 + "14"
+	ECode010315 = e.Code0103 + "15"
 )
 
 // MigrationGetParam get params
@@ -33,6 +45,7 @@ type MigrationGetParam struct {
 	Offset         uint64
 	ID             *int
 	Version        *int
+	MinVersion     *int // Only return migrations with a version greater or equal to this
 	Code           *string
 	Status         *string
 	FlagCount      bool
@@ -46,6 +59,12 @@ type MigrationUpdateParam struct {
 	Status  *string
 	SQL     *string
 	Err     *string
+	// Checksum of the SQL, the column is added by the migrator's own migrations, so
+	// only set it once they have run
+	Checksum *string
+	// Duration of the run, also sets the finished on time. Like the checksum, only set
+	// it once the migrator's own migrations have added the history columns
+	Duration *time.Duration
 }
 
 // MigrationInsertParam insert params
@@ -104,6 +123,15 @@ func MigrationUpdate(ctx context.Context, db *sql.Connection, id int, up *Migrat
 		ub = ub.Set("skyrin_migration_err", *up.Err)
 	}
 
+	if up.Checksum != nil {
+		ub = ub.Set("skyrin_migration_checksum", *up.Checksum)
+	}
+
+	if up.Duration != nil {
+		ub = ub.Set("skyrin_migration_finished_on", "now()").
+			Set("skyrin_migration_duration_ms", up.Duration.Milliseconds())
+	}
+
 	err = db.ExecUpdate(ctx, ub)
 	if err != nil {
 		return e.W(err, ECode010302,
@@ -137,6 +165,10 @@ func MigrationGet(ctx context.Context, db *sql.Connection,
 		sb = sb.Where("skyrin_migration_version=?", *p.Version)
 	}
 
+	if p.MinVersion != nil {
+		sb = sb.Where("skyrin_migration_version>=?", *p.MinVersion)
+	}
+
 	if p.Code != nil {
 		sb = sb.Where("skyrin_migration_code=?", *p.Code)
 	}
@@ -236,3 +268,125 @@ func MigrationGetLatest(ctx context.Context, db *sql.Connection, code string) (m
 
 	return mList[0], nil
 }
+
+// MigrationGetLatestComplete retrieves the latest complete migration. Versions after it
+// are either pending, failed or reverted and still need to be run.
+func MigrationGetLatestComplete(ctx context.Context, db *sql.Connection, code string) (m *model.Migration, err error) {
+	status := model.MIGRATION_STATUS_COMPLETE
+	mList, _, err := MigrationGet(ctx, db, &MigrationGetParam{
+		Limit:          1,
+		Code:           &code,
+		Status:         &status,
+		OrderByVersion: "desc",
+	})
+	if err != nil {
+		// Check for table does not exist error
+		if e.ContainsError(err, e.PQErr42P01) {
+			return nil, e.N(ECode01030C, e.MsgMigrationNotInstalled)
+		}
+		return nil, e.W(err, ECode01030D)
+	}
+
+	if len(mList) != 1 {
+		return nil, e.N(ECode01030E, e.MsgMigrationNone)
+	}
+
+	return mList[0], nil
+}
+
+// MigrationGetChecksumList returns all migrations of the code, sorted by version, with
+// only their id, code, version, status and checksum set
+func MigrationGetChecksumList(ctx context.Context, db *sql.Connection,
+	code string) (mList []*model.Migration, err error) {
+	stmt := `SELECT skyrin_migration_id,skyrin_migration_code,skyrin_migration_version,
+		skyrin_migration_status,skyrin_migration_checksum
+		FROM skyrin_migration
+		WHERE skyrin_migration_code=$1
+		ORDER BY skyrin_migration_version`
+
+	rows, err := db.Query(ctx, stmt, code)
+	if err != nil {
+		return nil, e.W(err, ECode01030F, fmt.Sprintf("code: %s", code))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := &model.Migration{}
+		if err := rows.Scan(&m.ID, &m.Code, &m.Version,
+			&m.Status, &m.Checksum); err != nil {
+			return nil, e.W(err, ECode010310, fmt.Sprintf("code: %s", code))
+		}
+
+		mList = append(mList, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, e.W(err, ECode010311, fmt.Sprintf("code: %s", code))
+	}
+
+	return mList, nil
+}
+
+// MigrationStart records the start of an attempt to run the migration, incrementing its
+// attempts. It should not be in the txn running the migration, so failed attempts are
+// also counted.
+func MigrationStart(ctx context.Context, db *sql.Connection, id int, host, appVersion string) (err error) {
+	ub := db.Update(MigrationTableName).
+		Set("updated_on", "now()").
+		Set("skyrin_migration_started_on", "now()").
+		Set("skyrin_migration_finished_on", nil).
+		Set("skyrin_migration_duration_ms", nil).
+		Set("skyrin_migration_host", host).
+		Set("skyrin_migration_app_version", appVersion).
+		Set("skyrin_migration_attempts", sq.Expr("skyrin_migration_attempts+1")).
+		Where("skyrin_migration_id=?", id)
+
+	if err := db.ExecUpdate(ctx, ub); err != nil {
+		return e.W(err, ECode010312, fmt.Sprintf("params: %d, %s, %s", id, host, appVersion))
+	}
+
+	return nil
+}
+
+// MigrationGetHistory returns all migrations of the code, sorted by version, with their
+// run history. The SQL is not returned.
+func MigrationGetHistory(ctx context.Context, db *sql.Connection,
+	code string) (mList []*model.Migration, err error) {
+	stmt := `SELECT skyrin_migration_id,skyrin_migration_code,skyrin_migration_version,
+		skyrin_migration_status,skyrin_migration_err,skyrin_migration_checksum,
+		COALESCE(skyrin_migration_started_on::TEXT, ''),
+		COALESCE(skyrin_migration_finished_on::TEXT, ''),
+		COALESCE(skyrin_migration_duration_ms, 0),
+		skyrin_migration_host,skyrin_migration_app_version,skyrin_migration_attempts,
+		created_on::TEXT,updated_on::TEXT
+		FROM skyrin_migration
+		WHERE skyrin_migration_code=$1
+		ORDER BY skyrin_migration_version`
+
+	rows, err := db.Query(ctx, stmt, code)
+	if err != nil {
+		return nil, e.W(err, ECode010313, fmt.Sprintf("code: %s", code))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := &model.Migration{}
+		var durationMS int64
+		if err := rows.Scan(&m.ID, &m.Code, &m.Version,
+			&m.Status, &m.Err, &m.Checksum,
+			&m.StartedOn, &m.FinishedOn, &durationMS,
+			&m.Host, &m.AppVersion, &m.Attempts,
+			&m.CreatedOn, &m.UpdatedOn); err != nil {
+			return nil, e.W(err, ECode010314, fmt.Sprintf("code: %s", code))
+		}
+		m.Duration = time.Duration(durationMS) * time.Millisecond
+
+		mList = append(mList, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, e.W(err, ECode010315, fmt.Sprintf("code: %s", code))
+	}
+
+	return mList, nil
+}
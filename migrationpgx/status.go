@@ -0,0 +1,146 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/migrationpgx/model"
+	"github.com/Skyrin/go-lib/migrationpgx/sqlmodel"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ECode010601 = e.Code0106 + "01"
+	ECode010602 = e.Code0106 + "02"
+	ECode010603 = e.Code0106 + "03"
+	ECode010604 = e.Code0106 + "04"
+	ECode010605 = e.Code0106 + "05"
+	ECode010606 = e.Code0106 + "06"
+	ECode010607 = e.Code0106 + "07"
+	ECode010608 = e.Code0106 + "08"
+	ECode010609 = e.Code0106 + "09"
+)
+
+// ListStatus the migration status of a migration list
+type ListStatus struct {
+	Code    string
+	Version int   // The latest complete version
+	Applied []int // Complete versions
+	Pending []int // Versions that have not run yet, or were reverted
+	Failed  []int // Versions that failed, they run again on the next upgrade
+}
+
+// Status returns the migration status of all added migration lists, in the order they
+// were added
+func (m *Migrator) Status(ctx context.Context) (lsList []*ListStatus, err error) {
+	for _, ml := range m.migrations {
+		ls, err := m.getListStatus(ctx, ml)
+		if err != nil {
+			return nil, e.W(err, ECode010601)
+		}
+		lsList = append(lsList, ls)
+	}
+
+	return lsList, nil
+}
+
+// getListStatus returns the migration status of the migration list
+func (m *Migrator) getListStatus(ctx context.Context, ml *List) (ls *ListStatus, err error) {
+	fList, err := ml.GetMigrationFiles()
+	if err != nil {
+		return nil, e.W(err, ECode010602)
+	}
+
+	mList, _, err := sqlmodel.MigrationGet(ctx, m.db, &sqlmodel.MigrationGetParam{
+		Limit:          math.MaxInt32,
+		Code:           &ml.code,
+		OrderByVersion: "asc",
+	})
+	if err != nil {
+		return nil, e.W(err, ECode010603)
+	}
+
+	statusMap := make(map[int]model.MigrationStatus, len(mList))
+	for _, mm := range mList {
+		statusMap[mm.Version] = mm.Status
+	}
+
+	ls = &ListStatus{Code: ml.code}
+	for _, f := range fList {
+		switch statusMap[f.Version] {
+		case model.MIGRATION_STATUS_COMPLETE:
+			ls.Applied = append(ls.Applied, f.Version)
+			ls.Version = f.Version
+		case model.MIGRATION_STATUS_FAILED:
+			ls.Failed = append(ls.Failed, f.Version)
+		default:
+			ls.Pending = append(ls.Pending, f.Version)
+		}
+	}
+
+	return ls, nil
+}
+
+// MarkApplied marks the versions of the migration list with the code, up to and
+// including the specified version, as complete without running them. Use it to
+// baseline a database whose schema was created outside of the migrator.
+func (m *Migrator) MarkApplied(ctx context.Context, code string, version int) (err error) {
+	ml, err := m.getList(code)
+	if err != nil {
+		return e.W(err, ECode010604)
+	}
+
+	if err := m.mustLock(ctx); err != nil {
+		return e.W(err, ECode010605)
+	}
+	defer m.unlock(ctx)
+
+	if err := m.loadListFiles(ctx, ml); err != nil {
+		return e.W(err, ECode010606)
+	}
+
+	if version <= 0 || len(ml.files) == 0 || ml.files[len(ml.files)-1].Version < version {
+		return e.N(ECode010607, fmt.Sprintf("%s: %s/%d",
+			e.MsgMigrationVersionNotFound, code, version))
+	}
+
+	for _, f := range ml.files {
+		if f.Version > version {
+			break
+		}
+
+		id, run, err := m.checkShouldRunFile(ctx, ml, f)
+		if err != nil {
+			return e.W(err, ECode010608)
+		}
+		if !run {
+			continue
+		}
+
+		status := model.MIGRATION_STATUS_COMPLETE
+		errMsg := ""
+		up := &sqlmodel.MigrationUpdateParam{
+			Status: &status,
+			Err:    &errMsg,
+		}
+		if m.useChecksum(ml, f) {
+			checksum := f.Checksum()
+			up.Checksum = &checksum
+		}
+
+		if err := sqlmodel.MigrationUpdate(ctx, m.db, id, up); err != nil {
+			return e.W(err, ECode010609)
+		}
+
+		if f.Version > ml.version {
+			ml.version = f.Version
+		}
+
+		log.Info().Str("instance", m.instance).Msgf("marked '%s' version: %v as applied",
+			ml.code, f.Version)
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/migrationpgx/model"
+	"github.com/Skyrin/go-lib/migrationpgx/sqlmodel"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MIGRATION_CHECKSUM_VERSION the version of the migrator's own migrations that adds
+	// the checksum column
+	MIGRATION_CHECKSUM_VERSION = 3
+
+	DriftEdited  = DriftType("edited")  // The file of a complete version was changed after it ran
+	DriftMissing = DriftType("missing") // The file's version never ran, but a later version did
+	DriftUnknown = DriftType("unknown") // A complete version in the DB has no file
+
+	ECode010501 = e.Code0105 + "01"
+	ECode010502 = e.Code0105 + "02"
+	ECode010503 = e.Code0105 + "03"
+	ECode010504 = e.Code0105 + "04"
+	ECode010505 = e.Code0105 + "05"
+)
+
+// DriftType the type of difference between a migration list and the migrations table
+type DriftType string
+
+// Drift a difference between a migration list's files and the versions recorded in
+// the skyrin_migration table
+type Drift struct {
+	Code    string
+	Version int
+	Type    DriftType
+}
+
+// String returns a readable description of the drift
+func (d *Drift) String() string {
+	return fmt.Sprintf("%s/%d: %s", d.Code, d.Version, d.Type)
+}
+
+// SetStrict sets whether Upgrade refuses to run if Verify finds any drift. If not
+// strict, the drift is logged as a warning and the upgrade continues.
+func (m *Migrator) SetStrict(strict bool) {
+	m.strict = strict
+}
+
+// Verify compares the files of all added migration lists with the versions recorded
+// in the skyrin_migration table, returning the versions that were edited after they
+// ran, that were skipped (missing) or that have no file (unknown), sorted by list and
+// version. It returns no drift if the migrator's own migrations have not added the
+// checksum column yet.
+func (m *Migrator) Verify(ctx context.Context) (driftList []*Drift, err error) {
+	if !m.hasChecksum() {
+		return nil, nil
+	}
+
+	for _, ml := range m.migrations {
+		dList, err := m.verifyList(ctx, ml)
+		if err != nil {
+			return nil, e.W(err, ECode010501)
+		}
+		driftList = append(driftList, dList...)
+	}
+
+	return driftList, nil
+}
+
+// verifyList compares the files of the migration list with its recorded versions
+func (m *Migrator) verifyList(ctx context.Context, ml *List) (driftList []*Drift, err error) {
+	fList, err := ml.GetMigrationFiles()
+	if err != nil {
+		return nil, e.W(err, ECode010502)
+	}
+
+	mList, err := sqlmodel.MigrationGetChecksumList(ctx, m.db, ml.code)
+	if err != nil {
+		return nil, e.W(err, ECode010503)
+	}
+
+	fileMap := make(map[int]*File, len(fList))
+	for _, f := range fList {
+		fileMap[f.Version] = f
+	}
+
+	completeMap := make(map[int]bool, len(mList))
+	maxComplete := 0
+	for _, mm := range mList {
+		if mm.Status != model.MIGRATION_STATUS_COMPLETE {
+			continue
+		}
+		completeMap[mm.Version] = true
+		if mm.Version > maxComplete {
+			maxComplete = mm.Version
+		}
+	}
+
+	for _, f := range fList {
+		if f.Version < maxComplete && !completeMap[f.Version] {
+			driftList = append(driftList, &Drift{Code: ml.code, Version: f.Version, Type: DriftMissing})
+		}
+	}
+
+	for _, mm := range mList {
+		if !completeMap[mm.Version] {
+			continue
+		}
+
+		f, ok := fileMap[mm.Version]
+		switch {
+		case !ok:
+			driftList = append(driftList, &Drift{Code: ml.code, Version: mm.Version, Type: DriftUnknown})
+		case mm.Checksum != "" && mm.Checksum != f.Checksum():
+			driftList = append(driftList, &Drift{Code: ml.code, Version: mm.Version, Type: DriftEdited})
+		}
+	}
+
+	sortDriftList(driftList)
+
+	return driftList, nil
+}
+
+// checkDrift verifies the migration lists before an upgrade. In strict mode any drift
+// is returned as an error, otherwise it is logged.
+func (m *Migrator) checkDrift(ctx context.Context) (err error) {
+	driftList, err := m.Verify(ctx)
+	if err != nil {
+		return e.W(err, ECode010504)
+	}
+
+	if len(driftList) == 0 {
+		return nil
+	}
+
+	sList := make([]string, len(driftList))
+	for i, d := range driftList {
+		sList[i] = d.String()
+	}
+
+	if m.strict {
+		return e.N(ECode010505, fmt.Sprintf("%s: %s", e.MsgMigrationDrift,
+			strings.Join(sList, ", ")))
+	}
+
+	log.Warn().Str("instance", m.instance).Strs("drift", sList).Msg(e.MsgMigrationDrift)
+
+	return nil
+}
+
+// hasChecksum checks if the migrator's own migrations have added the checksum column
+func (m *Migrator) hasChecksum() bool {
+	ml, err := m.getList(MIGRATION_CODE)
+	return err == nil && ml.version >= MIGRATION_CHECKSUM_VERSION
+}
+
+// useChecksum checks if the checksum should be saved when the file completes. This is
+// also the case for the migrator's own file that adds the checksum column, as it
+// runs in the same txn as the status update.
+func (m *Migrator) useChecksum(ml *List, f *File) bool {
+	return m.hasChecksum() ||
+		(ml.code == MIGRATION_CODE && f.Version >= MIGRATION_CHECKSUM_VERSION)
+}
+
+// sortDriftList sorts the drift of a migration list by version
+func sortDriftList(driftList []*Drift) {
+	sort.SliceStable(driftList, func(i, j int) bool {
+		return driftList[i].Version < driftList[j].Version
+	})
+}
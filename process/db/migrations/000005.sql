@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Add columns for processes that run on a cron schedule instead of a fixed interval
+ALTER TABLE process
+	ADD COLUMN IF NOT EXISTS process_schedule TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS process_time_zone TEXT NOT NULL DEFAULT '';
+
+COMMIT;
\ No newline at end of file
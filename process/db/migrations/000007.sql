@@ -0,0 +1,10 @@
+BEGIN;
+
+-- Add columns for the lease on a process, held by the instance running it and renewed
+-- while it runs, so no txn is held open during the run
+ALTER TABLE process
+	ADD COLUMN IF NOT EXISTS process_lease_owner TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS process_lease_until TIMESTAMP NULL,
+	ADD COLUMN IF NOT EXISTS process_lease_run_id BIGINT NULL;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,4 @@
+-- migrate:no-transaction
+
+-- Runs cancelled because they ran longer than the process's max run time
+ALTER TYPE process_run_status ADD VALUE IF NOT EXISTS 'timeout';
\ No newline at end of file
@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Add the max time a process may run before it is cancelled, 0 for no limit
+ALTER TABLE process
+	ADD COLUMN IF NOT EXISTS process_max_run_time INTERVAL NOT NULL DEFAULT '0';
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,12 @@
+BEGIN;
+
+-- Add the retry policy of a process and its count of consecutive failed runs, failed runs
+-- are retried sooner than the regular cadence up to the max attempts
+ALTER TABLE process
+	ADD COLUMN IF NOT EXISTS process_retry_max_attempts INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS process_retry_backoff INTERVAL NOT NULL DEFAULT '0',
+	ADD COLUMN IF NOT EXISTS process_retry_max_backoff INTERVAL NOT NULL DEFAULT '0',
+	ADD COLUMN IF NOT EXISTS process_retry_jitter DOUBLE PRECISION NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS process_retry_attempt INTEGER NOT NULL DEFAULT 0;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,4 @@
+-- migrate:no-transaction
+
+-- Runs of downstream processes that did not run because an upstream process did not complete
+ALTER TYPE process_run_status ADD VALUE IF NOT EXISTS 'skipped';
\ No newline at end of file
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	"github.com/Skyrin/go-lib/e"
 	"github.com/Skyrin/go-lib/process/model"
 	"github.com/Skyrin/go-lib/sql"
@@ -32,6 +33,17 @@ const (
 	ECode03020F_lock_alreadyRunning = e.Code0302 + "0F"
 	ECode03020G_lock_statusInactive = e.Code0302 + "0G"
 	ECode03020H_lock_notReady       = e.Code0302 + "0H"
+	ECode03020I                     = e.Code0302 + "0I"
+	ECode03020J                     = e.Code0302 + "0J"
+	ECode03020K                     = e.Code0302 + "0K"
+	ECode03020L                     = e.Code0302 + "0L"
+	ECode03020M                     = e.Code0302 + "0M"
+	ECode03020N_renewLease_lost     = e.Code0302 + "0N"
+	ECode03020O                     = e.Code0302 + "0O"
+	ECode03020P                     = e.Code0302 + "0P"
+	ECode03020Q                     = e.Code0302 + "0Q"
+	ECode03020R                     = e.Code0302 + "0R"
+	ECode03020S                     = e.Code0302 + "0S"
 )
 
 // ProcessGetParam get params
@@ -40,21 +52,31 @@ type ProcessGetParam struct {
 	Offset               int
 	ID                   *int
 	Code                 *string
+	CodeList             []string
 	FlagCount            bool
 	OrderByID            string
 	ForNoKeyUpdateNoWait bool
 	Status               string
 	IsNextRunTime        bool
+	IsScheduled          bool
+	IsLeaseFree          bool
 }
 
 // ProcessUpsert upsert a record into the process table
 func ProcessUpsert(db *sql.Connection, p *model.Process) (id int, err error) {
+	var nextRunTime interface{} = p.NextRunTime
+	if p.Schedule != "" {
+		nextRunTime = getRunTimeExpr(p.NextRunTime)
+	}
+
 	sb := db.Insert(ProcessTable).
 		Columns("process_code", "process_name", "process_status",
 			"process_next_run_time", "process_interval",
+			"process_schedule", "process_time_zone",
 			"process_message", "created_on", "updated_on").
 		Values(p.Code, p.Name, model.ProcessStatusActive,
-			p.NextRunTime, p.Interval.Seconds(),
+			nextRunTime, p.Interval.Seconds(),
+			p.Schedule, p.TimeZone,
 			"", "now()", "now()").
 		Suffix(`ON CONFLICT ON CONSTRAINT process__ukey DO UPDATE
 		SET process_name=excluded.process_name, updated_on=now() 
@@ -72,6 +94,12 @@ func ProcessUpsert(db *sql.Connection, p *model.Process) (id int, err error) {
 func ProcessGet(db *sql.Connection, p *ProcessGetParam) (pList []*model.Process, count int, err error) {
 	fields := `process_id, process_code, process_name, process_status,
 		process_last_run_time, process_next_run_time, EXTRACT(EPOCH FROM process_interval)::INTEGER,
+		process_schedule, process_time_zone,
+		process_lease_owner, process_lease_until, COALESCE(process_lease_run_id, 0),
+		EXTRACT(EPOCH FROM process_max_run_time)::INTEGER,
+		process_retry_max_attempts, EXTRACT(MICROSECONDS FROM process_retry_backoff)::BIGINT,
+		EXTRACT(MICROSECONDS FROM process_retry_max_backoff)::BIGINT, process_retry_jitter,
+		process_retry_attempt,
 		process_total_success, EXTRACT(MICROSECONDS FROM process_avg_run_time)::INTEGER,
 		process_message, created_on, updated_on`
 
@@ -91,6 +119,10 @@ func ProcessGet(db *sql.Connection, p *ProcessGetParam) (pList []*model.Process,
 		sb = sb.Where("process_code = ?", *p.Code)
 	}
 
+	if len(p.CodeList) > 0 {
+		sb = sb.Where(sq.Eq{"process_code": p.CodeList})
+	}
+
 	if p.Status != "" {
 		sb = sb.Where("process_status=?", p.Status)
 	}
@@ -101,6 +133,14 @@ func ProcessGet(db *sql.Connection, p *ProcessGetParam) (pList []*model.Process,
 		sb = sb.Where("process_next_run_time<NOW()")
 	}
 
+	if p.IsScheduled {
+		sb = sb.Where("(process_interval>MAKE_INTERVAL(secs => 0) OR process_schedule<>'')")
+	}
+
+	if p.IsLeaseFree {
+		sb = sb.Where("(process_lease_until IS NULL OR process_lease_until<NOW())")
+	}
+
 	if p.FlagCount {
 		// Get the count before applying an offset if there is one
 		count, err = db.QueryCount(sb)
@@ -129,22 +169,36 @@ func ProcessGet(db *sql.Connection, p *ProcessGetParam) (pList []*model.Process,
 	for rows.Next() {
 		d := &model.Process{}
 		lrt := &gosql.NullTime{}
+		lut := &gosql.NullTime{}
 		successCount := gosql.NullInt64{}
-		var interval, averageRunTime int64
+		var interval, maxRunTime, retryBackoff, retryMaxBackoff, averageRunTime int64
 		if err := rows.Scan(&d.ID, &d.Code, &d.Name, &d.Status,
 			lrt, &d.NextRunTime, &interval,
+			&d.Schedule, &d.TimeZone,
+			&d.LeaseOwner, lut, &d.LeaseRunID,
+			&maxRunTime,
+			&d.Retry.MaxAttempts, &retryBackoff,
+			&retryMaxBackoff, &d.Retry.Jitter,
+			&d.RetryAttempt,
 			&successCount, &averageRunTime,
 			&d.Message, &d.CreatedOn, &d.UpdatedOn); err != nil {
 			return nil, 0, e.W(err, ECode030204)
 		}
 
 		d.Interval = time.Duration(interval) * time.Second
+		d.MaxRunTime = time.Duration(maxRunTime) * time.Second
+		d.Retry.Backoff = time.Duration(retryBackoff) * time.Microsecond
+		d.Retry.MaxBackoff = time.Duration(retryMaxBackoff) * time.Microsecond
 		d.AverageRunTime = time.Duration(averageRunTime) * time.Microsecond // Average run time is extracted as micro seconds
 
 		if lrt.Valid {
 			d.LastRunTime = lrt.Time
 		}
 
+		if lut.Valid {
+			d.LeaseUntil = lut.Time
+		}
+
 		if successCount.Valid {
 			d.SuccessCount = int(successCount.Int64)
 		}
@@ -171,6 +225,24 @@ func ProcessGetByCode(db *sql.Connection, code string) (p *model.Process, err er
 	return pList[0], nil
 }
 
+// ProcessGetDue returns the active processes of the codes that have an interval or
+// schedule, are past their next run time and are not leased by a running instance
+func ProcessGetDue(db *sql.Connection, codeList []string) (pList []*model.Process, err error) {
+	pList, _, err = ProcessGet(db, &ProcessGetParam{
+		Limit:         len(codeList),
+		CodeList:      codeList,
+		Status:        model.ProcessStatusActive,
+		IsNextRunTime: true,
+		IsScheduled:   true,
+		IsLeaseFree:   true,
+	})
+	if err != nil {
+		return nil, e.W(err, ECode03020I)
+	}
+
+	return pList, nil
+}
+
 // ProcessGetByID returns the process record with the specified id
 func ProcessGetByID(db *sql.Connection, id int) (p *model.Process, err error) {
 	pList, _, err := ProcessGet(db, &ProcessGetParam{
@@ -189,15 +261,17 @@ func ProcessGetByID(db *sql.Connection, id int) (p *model.Process, err error) {
 
 // ProcessLock attempts to establish a lock on the specified process. The process will be skipped
 // in the following scenarios:
-// 1. The process is already running (the row is already locked)
+// 1. The process is already running (the row is already locked or its lease has not expired)
 // 2. The process is no longer active
-// 3. The process has an interval and it is not currently past the process's next run time
-func ProcessLock(db *sql.Connection, id int) (p *model.Process, err error) {
+// 3. The process has an interval and it is not currently past the process's next run time,
+// unless the next run time is ignored, e.g. the run was triggered by an upstream process
+func ProcessLock(db *sql.Connection, id int, ignoreNextRunTime bool) (p *model.Process, err error) {
 	pList, _, err := ProcessGet(db, &ProcessGetParam{
 		ID:                   &id,
 		ForNoKeyUpdateNoWait: true,
 		Status:               model.ProcessStatusActive,
-		IsNextRunTime:        true,
+		IsNextRunTime:        !ignoreNextRunTime,
+		IsLeaseFree:          true,
 	})
 	if err != nil {
 		// Special case if failed due to FOR NO KEY UPDATE NOWAIT
@@ -220,6 +294,20 @@ func ProcessLock(db *sql.Connection, id int) (p *model.Process, err error) {
 			return nil, e.N(ECode03020G_lock_statusInactive, "process is inactive")
 		}
 
+		// Check if another instance holds the lease
+		pList, _, err = ProcessGet(db, &ProcessGetParam{
+			ID:          &id,
+			IsLeaseFree: true,
+		})
+		if err != nil {
+			return nil, e.W(err, ECode03020L)
+		}
+
+		if len(pList) == 0 {
+			return nil, e.N(ECode03020F_lock_alreadyRunning,
+				fmt.Sprintf("process lease held by '%s'", p.LeaseOwner))
+		}
+
 		// Otherwise, it should have failed because it is not time to run it yet
 		return nil, e.N(ECode03020H_lock_notReady, "process not ready to run")
 	}
@@ -267,10 +355,157 @@ func ProcessSetRunTime(db *sql.Connection, id int) (err error) {
 	return nil
 }
 
+// ProcessSetScheduledRunTime sets the process's last run time as now and the next run
+// time as the next time of its schedule
+func ProcessSetScheduledRunTime(db *sql.Connection, id int, nextRunTime time.Time) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_last_run_time", db.Expr("NOW()")).
+		Set("process_next_run_time", getRunTimeExpr(nextRunTime)).
+		Where("process_id=?", id)
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode03020J, fmt.Sprintf("id: %d", id))
+	}
+
+	return nil
+}
+
+// ProcessSetSchedule updates the schedule of the process and sets its next run time
+func ProcessSetSchedule(db *sql.Connection, id int, schedule, timeZone string,
+	nextRunTime time.Time) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_schedule", schedule).
+		Set("process_time_zone", timeZone).
+		Set("process_next_run_time", getRunTimeExpr(nextRunTime)).
+		Set("updated_on", db.Expr("NOW()")).
+		Where("process_id=?", id)
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode03020K, fmt.Sprintf("id: %d, schedule: %s, tz: %s",
+			id, schedule, timeZone))
+	}
+
+	return nil
+}
+
+// ProcessSetLease gives the lease on the process to the owner for the duration, along
+// with the run it is for
+func ProcessSetLease(db *sql.Connection, id int, owner string, runID int,
+	lease time.Duration) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_lease_owner", owner).
+		Set("process_lease_until", db.Expr("NOW() + MAKE_INTERVAL(secs => ?)", lease.Seconds())).
+		Set("process_lease_run_id", runID).
+		Where("process_id=?", id)
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode03020M, fmt.Sprintf("id: %d, owner: %s", id, owner))
+	}
+
+	return nil
+}
+
+// ProcessRenewLease extends the owner's lease on the process by the duration. Returns
+// ECode03020N_renewLease_lost if the owner no longer holds the lease.
+func ProcessRenewLease(db *sql.Connection, id int, owner string,
+	lease time.Duration) (err error) {
+	stmt := `UPDATE process
+		SET process_lease_until=NOW() + MAKE_INTERVAL(secs => $1)
+		WHERE process_id=$2 AND process_lease_owner=$3
+		RETURNING process_id`
+
+	if err := db.QueryRow(stmt, lease.Seconds(), id, owner).Scan(&id); err != nil {
+		if e.IsNoRowsPQError(err) {
+			return e.N(ECode03020N_renewLease_lost,
+				fmt.Sprintf("process lease lost, id: %d, owner: %s", id, owner))
+		}
+		return e.W(err, ECode03020O, fmt.Sprintf("id: %d, owner: %s", id, owner))
+	}
+
+	return nil
+}
+
+// ProcessReleaseLease releases the owner's lease on the process, if it still holds it
+func ProcessReleaseLease(db *sql.Connection, id int, owner string) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_lease_owner", "").
+		Set("process_lease_until", nil).
+		Set("process_lease_run_id", nil).
+		Where("process_id=? AND process_lease_owner=?", id, owner)
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode03020P, fmt.Sprintf("id: %d, owner: %s", id, owner))
+	}
+
+	return nil
+}
+
+// ProcessSetMaxRunTime update the max time a run of the process may take, 0 for no limit
+func ProcessSetMaxRunTime(db *sql.Connection, id int, maxRunTime time.Duration) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_max_run_time", db.Expr("MAKE_INTERVAL(secs => ?)", maxRunTime.Seconds())).
+		Where("process_id=?", id)
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode03020Q, fmt.Sprintf("id: %d, maxRunTime: %s", id, maxRunTime))
+	}
+
+	return nil
+}
+
+// ProcessSetRetryPolicy update the retry policy of the process
+func ProcessSetRetryPolicy(db *sql.Connection, id int, rp *model.RetryPolicy) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_retry_max_attempts", rp.MaxAttempts).
+		Set("process_retry_backoff", db.Expr("MAKE_INTERVAL(secs => ?)", rp.Backoff.Seconds())).
+		Set("process_retry_max_backoff", db.Expr("MAKE_INTERVAL(secs => ?)", rp.MaxBackoff.Seconds())).
+		Set("process_retry_jitter", rp.Jitter).
+		Where("process_id=?", id)
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode03020R, fmt.Sprintf("id: %d", id))
+	}
+
+	return nil
+}
+
+// ProcessSetRetryAttempt sets the count of consecutive failed runs that were retried. If the
+// retry time is not zero, the next run time is moved up to it, unless it is already sooner.
+func ProcessSetRetryAttempt(db *sql.Connection, id, attempt int, retryTime time.Time) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_retry_attempt", attempt).
+		Where("process_id=?", id)
+
+	if !retryTime.IsZero() {
+		ub = ub.Set("process_next_run_time",
+			db.Expr("LEAST(process_next_run_time, TO_TIMESTAMP(?)::TIMESTAMP)", float64(retryTime.Unix())))
+	}
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode03020S, fmt.Sprintf("id: %d, attempt: %d", id, attempt))
+	}
+
+	return nil
+}
+
+// getRunTimeExpr returns the expression to store the run time in a timestamp column. The
+// timestamp is converted by the DB, so it compares correctly with NOW() regardless of the
+// session time zone. The zero time is stored as the last day supported, i.e. never, as
+// infinity can not be scanned into a time.
+func getRunTimeExpr(t time.Time) sq.Sqlizer {
+	if t.IsZero() {
+		return sq.Expr("'9999-12-31'::TIMESTAMP")
+	}
+
+	return sq.Expr("TO_TIMESTAMP(?)::TIMESTAMP", float64(t.Unix()))
+}
+
 // ProcessSetLastSuccess sets the process's last successful run time as now and updates the process success
 // statistics, which include:
 //  1. The total number of successful runs
 //  2. The average run time
+//
+// It also resets the count of consecutive failed runs that were retried.
 func ProcessSetLastSuccess(db *sql.Connection, id int, runTime time.Duration) (err error) {
 	const setAvgRunTime = `MAKE_INTERVAL(secs =>
 		(COALESCE(EXTRACT(EPOCH FROM process_avg_run_time), 0) * COALESCE(process_total_success,0) + ?)
@@ -282,6 +517,7 @@ func ProcessSetLastSuccess(db *sql.Connection, id int, runTime time.Duration) (e
 		Set("process_total_success", db.Expr("COALESCE(process_total_success, 0) + 1")).
 		Set("process_avg_run_time",
 			db.Expr(setAvgRunTime, runTime.Seconds())).
+		Set("process_retry_attempt", 0).
 		Where("process_id=?", id)
 
 	if err := db.ExecUpdate(ub); err != nil {
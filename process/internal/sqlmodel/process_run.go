@@ -1,6 +1,7 @@
 package sqlmodel
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -20,6 +21,12 @@ const (
 	ECode030305 = e.Code0303 + "05"
 	ECode030306 = e.Code0303 + "06"
 	ECode030307 = e.Code0303 + "07"
+	ECode030308 = e.Code0303 + "08"
+	ECode030309 = e.Code0303 + "09"
+	ECode03030A = e.Code0303 + "0A"
+	ECode03030B = e.Code0303 + "0B"
+	ECode03030C = e.Code0303 + "0C"
+	ECode03030D = e.Code0303 + "0D"
 )
 
 // ProcessRunGetParam get params
@@ -28,14 +35,16 @@ type ProcessRunGetParam struct {
 	Offset    int
 	ID        *int
 	ProcessID *int
+	GroupID   *int
 	FlagCount bool
 	OrderByID string
 }
 
 // ProcessRunGet performs the DB query to return the list of docks
 func ProcessRunGet(db *sql.Connection, p *ProcessRunGetParam) (dList []*model.ProcessRun, count int, err error) {
-	fields := `process_run_id, process_id, process_run_status, 
+	fields := `process_run_id, process_id, COALESCE(process_run_group_id, 0), process_run_status,
 		EXTRACT(EPOCH FROM process_run_time)::INTEGER, process_run_error,
+		COALESCE(process_run_result::TEXT, ''),
 		created_on, updated_on`
 
 	if p.Limit == 0 {
@@ -54,6 +63,10 @@ func ProcessRunGet(db *sql.Connection, p *ProcessRunGetParam) (dList []*model.Pr
 		sb = sb.Where("process_id = ?", *p.ProcessID)
 	}
 
+	if p.GroupID != nil {
+		sb = sb.Where("process_run_group_id = ?", *p.GroupID)
+	}
+
 	if p.FlagCount {
 		// Get the count before applying an offset if there is one
 		count, err = db.QueryCount(sb)
@@ -65,7 +78,7 @@ func ProcessRunGet(db *sql.Connection, p *ProcessRunGetParam) (dList []*model.Pr
 	sb = sb.Offset(uint64(p.Offset))
 
 	if p.OrderByID != "" {
-		sb = sb.OrderBy(fmt.Sprintf("dock_code %s", p.OrderByID))
+		sb = sb.OrderBy(fmt.Sprintf("process_run_id %s", p.OrderByID))
 	}
 
 	// Perform the query
@@ -78,14 +91,19 @@ func ProcessRunGet(db *sql.Connection, p *ProcessRunGetParam) (dList []*model.Pr
 	for rows.Next() {
 		d := &model.ProcessRun{}
 		var runTime int64
-		if err := rows.Scan(&d.ID, &d.ProcessID,
+		var result string
+		if err := rows.Scan(&d.ID, &d.ProcessID, &d.GroupID,
 			&d.Status, &runTime,
-			&d.Error, &d.CreatedOn, &d.UpdatedOn); err != nil {
+			&d.Error, &result,
+			&d.CreatedOn, &d.UpdatedOn); err != nil {
 
 			return nil, 0, e.W(err, ECode030303)
 		}
 
 		d.RunTime = time.Duration(runTime) * time.Second
+		if result != "" {
+			d.Result = json.RawMessage(result)
+		}
 
 		dList = append(dList, d)
 	}
@@ -93,35 +111,98 @@ func ProcessRunGet(db *sql.Connection, p *ProcessRunGetParam) (dList []*model.Pr
 	return dList, count, nil
 }
 
-// ProcessRunCreate inserts a new record
-func ProcessRunCreate(db *sql.Connection, processID int) (pr *model.ProcessRun, err error) {
+// ProcessRunCreate inserts a new record in the run group. If the group id is 0, the record
+// starts a new run group, with its own id as the group id.
+func ProcessRunCreate(db *sql.Connection, processID, groupID int) (pr *model.ProcessRun, err error) {
+	pr, err = processRunInsert(db, processID, groupID, model.ProcessRunStatusRunning, "")
+	if err != nil {
+		return nil, e.W(err, ECode030304)
+	}
+
+	return pr, nil
+}
+
+// ProcessRunSkip inserts a new record in the run group, marked as skipped for the reason
+func ProcessRunSkip(db *sql.Connection, processID, groupID int,
+	msg string) (pr *model.ProcessRun, err error) {
+	pr, err = processRunInsert(db, processID, groupID, model.ProcessRunStatusSkipped, msg)
+	if err != nil {
+		return nil, e.W(err, ECode03030A)
+	}
+
+	return pr, nil
+}
+
+// ProcessRunGetLatest returns the latest record of the process, or nil if it never ran
+func ProcessRunGetLatest(db *sql.Connection, processID int) (pr *model.ProcessRun, err error) {
+	prList, _, err := ProcessRunGet(db, &ProcessRunGetParam{
+		ProcessID: &processID,
+		OrderByID: "DESC",
+	})
+	if err != nil {
+		return nil, e.W(err, ECode03030B, fmt.Sprintf("processID: %d", processID))
+	}
+
+	if len(prList) == 0 {
+		return nil, nil
+	}
+
+	return prList[0], nil
+}
+
+// processRunInsert inserts a new record with the status in the run group, see ProcessRunCreate
+func processRunInsert(db *sql.Connection, processID, groupID int, status,
+	msg string) (pr *model.ProcessRun, err error) {
 	now := time.Now()
 	pr = &model.ProcessRun{
 		ProcessID: processID,
-		Status:    model.ProcessRunStatusRunning,
+		GroupID:   groupID,
+		Status:    status,
+		Error:     msg,
 		CreatedOn: now,
 		UpdatedOn: now,
 	}
+
+	var group interface{}
+	if groupID > 0 {
+		group = groupID
+	}
+
 	sb := db.Insert(ProcessRunTable).
-		Columns("process_id", "process_run_status", "process_run_time", "process_run_error", "created_on", "updated_on").
-		Values(pr.ProcessID, pr.Status, pr.RunTime.Seconds(), pr.Error, pr.CreatedOn, pr.UpdatedOn).
+		Columns("process_id", "process_run_group_id", "process_run_status", "process_run_time",
+			"process_run_error", "created_on", "updated_on").
+		Values(pr.ProcessID, group, pr.Status, pr.RunTime.Seconds(),
+			pr.Error, pr.CreatedOn, pr.UpdatedOn).
 		Suffix("RETURNING process_run_id")
 	pr.ID, err = db.ExecInsertReturningID(sb)
 	if err != nil {
-		return nil, e.W(err, ECode030304)
+		return nil, err
+	}
+
+	if groupID == 0 {
+		// Start a new run group
+		ub := db.Update(ProcessRunTable).
+			Set("process_run_group_id", pr.ID).
+			Where("process_run_id = ?", pr.ID)
+
+		if err := db.ExecUpdate(ub); err != nil {
+			return nil, e.W(err, ECode03030C, fmt.Sprintf("id: %d", pr.ID))
+		}
+		pr.GroupID = pr.ID
 	}
 
 	return pr, nil
 }
 
-// ProcessRunComplete marks record as completed
+// ProcessRunComplete marks record as completed, if it is still running, i.e. it was not
+// abandoned after losing its lease
 func ProcessRunComplete(db *sql.Connection, id int, msg string, runTime time.Duration) (err error) {
 	ub := db.Update(ProcessRunTable).
 		Set("process_run_status", model.ProcessRunStatusCompleted).
 		Set("process_run_time", runTime.Seconds()).
 		Set("process_run_error", msg).
 		Set("updated_on", db.Expr("NOW()")).
-		Where("process_run_id = ?", id)
+		Where("process_run_id = ? AND process_run_status = ?", id, model.ProcessRunStatusRunning)
 
 	if err := db.ExecUpdate(ub); err != nil {
 		return e.W(err, ECode030305)
@@ -130,14 +211,14 @@ func ProcessRunComplete(db *sql.Connection, id int, msg string, runTime time.Dur
 	return nil
 }
 
-// ProcessRunFail marks record as failed
+// ProcessRunFail marks record as failed, if it is still running
 func ProcessRunFail(db *sql.Connection, id int, msg string, runTime time.Duration) (err error) {
 	ub := db.Update(ProcessRunTable).
 		Set("process_run_status", model.ProcessRunStatusFailed).
 		Set("process_run_time", runTime.Seconds()).
 		Set("process_run_error", msg).
 		Set("updated_on", "NOW()").
-		Where("process_run_id = ?", id)
+		Where("process_run_id = ? AND process_run_status = ?", id, model.ProcessRunStatusRunning)
 
 	if err := db.ExecUpdate(ub); err != nil {
 		return e.W(err, ECode030301)
@@ -146,6 +227,52 @@ func ProcessRunFail(db *sql.Connection, id int, msg string, runTime time.Duratio
 	return nil
 }
 
+// ProcessRunTimeout marks record as timed out, i.e. cancelled after running longer than
+// the process's max run time, if it is still running
+func ProcessRunTimeout(db *sql.Connection, id int, msg string, runTime time.Duration) (err error) {
+	ub := db.Update(ProcessRunTable).
+		Set("process_run_status", model.ProcessRunStatusTimeout).
+		Set("process_run_time", runTime.Seconds()).
+		Set("process_run_error", msg).
+		Set("updated_on", db.Expr("NOW()")).
+		Where("process_run_id = ? AND process_run_status = ?", id, model.ProcessRunStatusRunning)
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode030309, fmt.Sprintf("id: %d", id))
+	}
+
+	return nil
+}
+
+// ProcessRunSetResult sets the result of the record
+func ProcessRunSetResult(db *sql.Connection, id int, result json.RawMessage) (err error) {
+	ub := db.Update(ProcessRunTable).
+		Set("process_run_result", db.Expr("?::JSONB", string(result))).
+		Set("updated_on", db.Expr("NOW()")).
+		Where("process_run_id = ?", id)
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode03030D, fmt.Sprintf("id: %d", id))
+	}
+
+	return nil
+}
+
+// ProcessRunAbandon marks the record as abandoned, if it is still running
+func ProcessRunAbandon(db *sql.Connection, id int, msg string) (err error) {
+	ub := db.Update(ProcessRunTable).
+		Set("process_run_status", model.ProcessRunStatusAbandoned).
+		Set("process_run_error", msg).
+		Set("updated_on", db.Expr("NOW()")).
+		Where("process_run_id = ? AND process_run_status = ?", id, model.ProcessRunStatusRunning)
+
+	if err := db.ExecUpdate(ub); err != nil {
+		return e.W(err, ECode030308, fmt.Sprintf("id: %d", id))
+	}
+
+	return nil
+}
+
 // ProcessRunDelete deletes record
 func ProcessRunDelete(db *sql.Connection, id int, msg string) (err error) {
 	d := db.Delete(ProcessRunTable).
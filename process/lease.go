@@ -0,0 +1,114 @@
+package process
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/process/internal/sqlmodel"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultLeaseDuration how long a run's lease on its process lasts by default before it
+	// must be renewed
+	DefaultLeaseDuration = time.Minute
+	// MinLeaseDuration the shortest lease, so it can be renewed in time
+	MinLeaseDuration = time.Second
+
+	ECode030701 = e.Code0307 + "01"
+	ECode030702 = e.Code0307 + "02"
+	ECode030703 = e.Code0307 + "03"
+	ECode030704 = e.Code0307 + "04"
+)
+
+// SetLeaseDuration sets how long a run's lease on its process lasts. The lease is renewed
+// every third of the duration while the process runs, so another instance only takes over
+// the process once the duration passes without a renewal (i.e. this instance crashed).
+// If the lease is not positive, DefaultLeaseDuration is used instead, and it is at least
+// MinLeaseDuration.
+func (p *Processor) SetLeaseDuration(lease time.Duration) {
+	switch {
+	case lease <= 0:
+		lease = DefaultLeaseDuration
+	case lease < MinLeaseDuration:
+		lease = MinLeaseDuration
+	}
+
+	p.leaseDuration = lease
+}
+
+// heartbeat renews the lease on the process until the returned func is called. If the
+// lease is lost to another instance, or expires because it could not be renewed in time,
+// it calls cancel to stop the run, as the process may already run elsewhere.
+func (p *Processor) heartbeat(id int, cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(p.leaseDuration / 3)
+		defer ticker.Stop()
+
+		renewedOn := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if err := sqlmodel.ProcessRenewLease(p.db, id, p.owner, p.leaseDuration); err != nil {
+				if e.ContainsError(err, sqlmodel.ECode03020N_renewLease_lost) {
+					// Another instance took over, nothing left to renew
+					log.Warn().Err(e.W(err, ECode030701)).Msg("[Processor.heartbeat]")
+					cancel()
+					return
+				}
+				log.Warn().Err(e.W(err, ECode030702)).Msg("[Processor.heartbeat]")
+
+				if time.Since(renewedOn) >= p.leaseDuration {
+					// Another instance may take over now
+					log.Warn().Err(e.N(ECode030704, "lease expired")).Int("id", id).
+						Msg("[Processor.heartbeat]")
+					cancel()
+					return
+				}
+				// Try again on the next tick, the lease has not expired yet
+				continue
+			}
+			renewedOn = time.Now()
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// releaseLease releases this instance's lease on the process so it can run again
+func (p *Processor) releaseLease(id int) {
+	if err := sqlmodel.ProcessReleaseLease(p.db, id, p.owner); err != nil {
+		// The lease will expire on its own
+		log.Warn().Err(e.W(err, ECode030703)).Msg("[Processor.releaseLease]")
+	}
+}
+
+// getOwner returns an id unique to this processor, used as the owner of its leases
+func getOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(b))
+}
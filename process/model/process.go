@@ -14,6 +14,14 @@ type Process struct {
 	LastRunTime    time.Time
 	NextRunTime    time.Time
 	Interval       time.Duration
+	Schedule       string // Cron expression, see process.ParseSchedule
+	TimeZone       string // Time zone of the schedule
+	LeaseOwner     string // Instance running the process
+	LeaseUntil     time.Time
+	LeaseRunID     int           // Run of the lease owner
+	MaxRunTime     time.Duration // Runs are cancelled after this long, 0 for no limit
+	Retry          RetryPolicy   // How failed runs are retried
+	RetryAttempt   int           // Consecutive failed runs that were retried
 	Status         string
 	Message        string
 	SuccessCount   int
@@ -21,3 +29,12 @@ type Process struct {
 	CreatedOn      time.Time
 	UpdatedOn      time.Time
 }
+
+// RetryPolicy defines how soon a process with an interval or schedule runs again after a
+// failed run. The delay before each retry doubles, starting from the backoff.
+type RetryPolicy struct {
+	MaxAttempts int           // Retries after consecutive failed runs, 0 to not retry
+	Backoff     time.Duration // Delay before the first retry
+	MaxBackoff  time.Duration // Limit of the delay, 0 for no limit
+	Jitter      float64       // Fraction of the delay randomly added or removed, 0 to 1
+}
@@ -0,0 +1,17 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ProcessRequest a request to run a process with params, see process.Processor.Request
+type ProcessRequest struct {
+	ID        int
+	Code      string          // Code of the process to run
+	Params    json.RawMessage // Passed to the run
+	Owner     string          // Processor that claimed the request
+	ClaimedOn time.Time
+	RunID     int // Run started for the request, 0 while pending
+	CreatedOn time.Time
+}
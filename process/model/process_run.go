@@ -1,19 +1,27 @@
 package model
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 const (
 	ProcessRunStatusRunning   = "running"
 	ProcessRunStatusCompleted = "completed"
 	ProcessRunStatusFailed    = "failed"
+	ProcessRunStatusAbandoned = "abandoned"
+	ProcessRunStatusTimeout   = "timeout"
+	ProcessRunStatusSkipped   = "skipped"
 )
 
 type ProcessRun struct {
 	ID        int
 	ProcessID int
+	GroupID   int // Shared by the runs of a process and the downstream processes it triggered
 	Status    string
 	RunTime   time.Duration
 	Error     string
+	Result    json.RawMessage // Set by the run func, nil if it did not
 	CreatedOn time.Time
 	UpdatedOn time.Time
 }
@@ -0,0 +1,115 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/migration"
+	"github.com/Skyrin/go-lib/process/internal/sqlmodel"
+	"github.com/Skyrin/go-lib/sql"
+)
+
+// getTestDB connects to the database set with the DB* ENV variables (see
+// sql.GetConnParamFromENV) and installs the process migrations. The test is skipped if
+// no database is set.
+func getTestDB(t *testing.T) (db *sql.Connection) {
+	if os.Getenv("DBHOST") == "" && os.Getenv("DBCONFIGPATH") == "" {
+		t.Skip("DBHOST not set")
+	}
+
+	db, err := sql.NewPostgresConn(sql.GetConnParamFromENV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.DB.Close()
+	})
+
+	m, err := migration.NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddMigrationList(GetMigrationList()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// getTestCode returns a process code unique to the test run, removing the process and its
+// runs and requests once the test finishes
+func getTestCode(t *testing.T, db *sql.Connection) (code string) {
+	code = fmt.Sprintf("test-%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		for _, stmt := range []string{
+			`DELETE FROM process_request WHERE process_code=$1`,
+			`DELETE FROM process_run WHERE process_id IN
+				(SELECT process_id FROM process WHERE process_code=$1)`,
+			`DELETE FROM process WHERE process_code=$1`,
+		} {
+			if _, err := db.Exec(stmt, code); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	return code
+}
+
+func TestRequestKeepsNextRunTime(t *testing.T) {
+	db := getTestDB(t)
+	code := getTestCode(t, db)
+
+	p := NewProcessor(db)
+	runCount := 0
+	if err := p.RegisterWithInterval(code, code, time.Hour, func() error {
+		runCount++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := sqlmodel.ProcessGetByCode(db, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Request(code, map[string]int{"id": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.runRequests(); err != nil {
+		t.Fatal(err)
+	}
+	p.wg.Wait()
+
+	if runCount != 1 {
+		t.Fatalf("run count = %d, want 1", runCount)
+	}
+
+	after, err := sqlmodel.ProcessGetByCode(db, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !after.NextRunTime.Equal(before.NextRunTime) {
+		t.Errorf("next run time = %s, want it unchanged at %s", after.NextRunTime,
+			before.NextRunTime)
+	}
+}
+
+func TestSetMaxRunTimeNotRegistered(t *testing.T) {
+	p := NewProcessor(nil)
+	err := p.SetMaxRunTime("missing", time.Minute)
+	if err == nil || !e.ContainsError(err, ECode030112) {
+		t.Errorf("SetMaxRunTime() error = %v, want %s", err, ECode030112)
+	}
+}
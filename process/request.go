@@ -0,0 +1,146 @@
+package process
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/process/internal/sqlmodel"
+	"github.com/Skyrin/go-lib/process/model"
+	"github.com/Skyrin/go-lib/sql"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// CHANNEL_PROCESS_REQUEST_NOTIFY notified with the process code when a request is inserted
+	CHANNEL_PROCESS_REQUEST_NOTIFY = "process_request_notify"
+
+	ECode030A01 = e.Code030A + "01"
+	ECode030A02 = e.Code030A + "02"
+	ECode030A03 = e.Code030A + "03"
+	ECode030A04 = e.Code030A + "04"
+	ECode030A05 = e.Code030A + "05"
+	ECode030A06 = e.Code030A + "06"
+	ECode030A07 = e.Code030A + "07"
+	ECode030A08 = e.Code030A + "08"
+)
+
+// Request requests a run of the process with the params, marshalled as JSON and passed to
+// the run func in RunInfo.Params. It returns the id of the request. Any service can also
+// request a run by inserting the process code and params into the process_request table,
+// e.g. INSERT INTO process_request (process_code, process_request_params)
+// VALUES ('store-sync', '{"storeId": 42}'). Pending requests are run by Start, as soon as
+// it is notified if ListenForRequests was called, otherwise on its next poll. The run of a
+// request does not wait for the process's next run time, and does not trigger the
+// processes downstream of it.
+func (p *Processor) Request(code string, params interface{}) (id int, err error) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return 0, e.W(err, ECode030A01)
+	}
+
+	id, err = sqlmodel.ProcessRequestCreate(p.db, code, b)
+	if err != nil {
+		return 0, e.W(err, ECode030A02)
+	}
+
+	return id, nil
+}
+
+// ListenForRequests listens for requests inserted into the process_request table, so
+// Start runs them as soon as they are inserted instead of on its next poll. It stops
+// listening on Shutdown. It must be called before Start.
+func (p *Processor) ListenForRequests(cp *sql.ConnParam) (err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.started {
+		return e.N(ECode030A08, "processor already started")
+	}
+
+	if p.listener != nil {
+		return e.N(ECode030A03, "processor already listening for requests")
+	}
+
+	listener := pq.NewListener(sql.GetConnectionStr(cp), 10*time.Second, time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Warn().Err(e.W(err, ECode030A04)).Msg("[Processor.ListenForRequests]")
+			}
+		})
+	if err := listener.Listen(CHANNEL_PROCESS_REQUEST_NOTIFY); err != nil {
+		listener.Close()
+		return e.W(err, ECode030A05)
+	}
+
+	p.listener = listener
+
+	return nil
+}
+
+// runRequests claims the pending requests of the registered processes, at most one of each
+// process that is not already running on this instance, and starts a go routine to run
+// each with its params. A request that is skipped, e.g. because the process is running on
+// another instance, is released to be claimed again on a later poll.
+func (p *Processor) runRequests() (err error) {
+	codeList := make([]string, 0, len(p.runList))
+	for code := range p.runList {
+		codeList = append(codeList, code)
+	}
+
+	for len(codeList) > 0 {
+		req, err := sqlmodel.ProcessRequestClaim(p.db, codeList, p.owner, p.leaseDuration)
+		if err != nil {
+			return e.W(err, ECode030A06)
+		}
+
+		if req == nil {
+			return nil
+		}
+
+		codeList = slices.DeleteFunc(codeList, func(code string) bool {
+			return code == req.Code
+		})
+
+		if !p.claim(req.Code) {
+			p.releaseRequest(req)
+			continue
+		}
+
+		p.wg.Add(1)
+		go func(req *model.ProcessRequest) {
+			defer p.wg.Done()
+			defer p.release(req.Code)
+
+			rr, err := p.execute(req.Code, &runParam{request: req})
+			if err != nil {
+				log.Error().Err(err).Str("code", req.Code).Int("requestId", req.ID).
+					Msg("[Processor.runRequests]")
+				if rr == nil || rr.Run == nil {
+					// The run was not created, so try again later
+					p.releaseRequest(req)
+				}
+				return
+			}
+
+			if rr.Skipped {
+				log.Debug().Str("code", req.Code).Int("requestId", req.ID).
+					Str("reason", rr.SkipReason).Msg("[Processor.runRequests]")
+				p.releaseRequest(req)
+			}
+		}(req)
+	}
+
+	return nil
+}
+
+// releaseRequest releases the claim on the request, so it can be claimed again
+func (p *Processor) releaseRequest(req *model.ProcessRequest) {
+	if err := sqlmodel.ProcessRequestRelease(p.db, req.ID, p.owner); err != nil {
+		// The claim will time out on its own
+		log.Warn().Err(e.W(err, ECode030A07)).Int("requestId", req.ID).
+			Msg("[Processor.releaseRequest]")
+	}
+}
@@ -0,0 +1,39 @@
+package process
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/process/model"
+)
+
+func TestSetRetryPolicyError(t *testing.T) {
+	p := NewProcessor(nil)
+	p.runList = map[string]*run{"sync": {process: &model.Process{ID: 1, Code: "sync"}}}
+
+	tests := []struct {
+		name string
+		code string
+		rp   *model.RetryPolicy
+		want string
+	}{
+		{"not registered", "missing", &model.RetryPolicy{}, ECode030807},
+		{"not registered nil policy", "missing", nil, ECode030807},
+		{"negative max attempts", "sync", &model.RetryPolicy{MaxAttempts: -1}, ECode030801},
+		{"no backoff", "sync", &model.RetryPolicy{MaxAttempts: 3}, ECode030802},
+		{"jitter above 1", "sync",
+			&model.RetryPolicy{MaxAttempts: 3, Backoff: time.Second, Jitter: 1.5}, ECode030803},
+		{"negative jitter", "sync",
+			&model.RetryPolicy{MaxAttempts: 3, Backoff: time.Second, Jitter: -0.1}, ECode030803},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.SetRetryPolicy(tt.code, tt.rp)
+			if err == nil || !e.ContainsError(err, tt.want) {
+				t.Errorf("SetRetryPolicy() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
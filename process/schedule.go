@@ -0,0 +1,45 @@
+package process
+
+import (
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/internal/processutil"
+)
+
+const (
+	ECode030601 = e.Code0306 + "01"
+)
+
+// Schedule a cron schedule in a time zone, see ParseSchedule
+type Schedule = processutil.Schedule
+
+// Blackout a window in which a scheduled process does not run, e.g. a nightly
+// maintenance window. Start and End are times of day, HH:MM, in the schedule's time zone,
+// the window includes Start but not End and wraps midnight if End is before Start. If
+// Weekdays is set, the window only starts on those days.
+type Blackout = processutil.Blackout
+
+// ParseSchedule parses the cron expression in the time zone, an IANA name such as
+// America/Chicago. If the time zone is empty, UTC is used. The expression has 5 fields,
+// minute hour day-of-month month day-of-week, or 6 fields with a leading second field.
+// Each field is *, a value, a range (1-5), a step (*/15, 0-30/10) or a list of them
+// (1,15,30). Months and weekdays can also be names (JAN, MON), 7 is also Sunday and ? is
+// the same as *. If both the day of month and the day of week are restricted, either can
+// match, as in standard cron. The macros @yearly, @monthly, @weekly, @daily and @hourly
+// are also supported. An expression that never matches, e.g. 0 0 30 2 *, is an error.
+//
+//	0 2 * * *        2am daily
+//	0 9 * * MON-FRI  every weekday at 9:00
+//	*/30 * * * * *   every 30 seconds
+//
+// Run times are wall clock times in the time zone. A run time skipped by a daylight saving
+// time change (e.g. 2:30 when clocks go from 2:00 to 3:00) runs at the end of the change
+// (3:00), a run time repeated by a change (e.g. 1:30 when clocks go from 2:00 back to 1:00)
+// only runs the first time.
+func ParseSchedule(expr, tz string) (s *Schedule, err error) {
+	s, err = processutil.ParseSchedule(expr, tz)
+	if err != nil {
+		return nil, e.W(err, ECode030601)
+	}
+
+	return s, nil
+}
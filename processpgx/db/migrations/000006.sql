@@ -0,0 +1,4 @@
+-- migrate:no-transaction
+
+-- Runs of an instance that stopped renewing its lease, e.g. it crashed, are abandoned
+ALTER TYPE process_run_status ADD VALUE IF NOT EXISTS 'abandoned';
\ No newline at end of file
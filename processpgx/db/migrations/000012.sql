@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Add the run group, shared by the runs of a process and the downstream processes it triggered
+ALTER TABLE process_run
+	ADD COLUMN IF NOT EXISTS process_run_group_id BIGINT NULL;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,39 @@
+BEGIN;
+
+-- Requests to run a process with params, e.g. inserted by another service or by hand. A
+-- request is pending until a processor claims it and links the run it started for it.
+CREATE TABLE IF NOT EXISTS process_request (
+	process_request_id BIGSERIAL PRIMARY KEY NOT NULL,
+	process_code TEXT NOT NULL,
+	process_request_params JSONB NOT NULL DEFAULT '{}',
+	-- The processor that claimed the request, if any
+	process_request_owner TEXT NOT NULL DEFAULT '',
+	process_request_claimed_on TIMESTAMP NULL,
+	process_run_id BIGINT NULL REFERENCES process_run (process_run_id) ON DELETE CASCADE,
+	created_on TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS process_request__pending__idx ON process_request (process_request_id)
+	WHERE process_run_id IS NULL;
+
+-- Wakes the listening processors when a request is inserted
+CREATE OR REPLACE FUNCTION process_request_notify()
+RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('process_request_notify', NEW.process_code);
+	-- This is an 'after' trigger, so the result is ignored
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS process_request_notify ON process_request;
+CREATE TRIGGER process_request_notify
+	AFTER INSERT ON process_request
+	FOR EACH ROW
+	EXECUTE PROCEDURE process_request_notify();
+
+-- Add the result of a run, set by the run func
+ALTER TABLE process_run
+	ADD COLUMN IF NOT EXISTS process_run_result JSONB NULL;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,129 @@
+package processpgx
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/internal/processutil"
+	"github.com/Skyrin/go-lib/processpgx/internal/sqlmodel"
+	"github.com/Skyrin/go-lib/processpgx/model"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ECode0A0901 = e.Code0A09 + "01"
+	ECode0A0902 = e.Code0A09 + "02"
+	ECode0A0903 = e.Code0A09 + "03"
+	ECode0A0904 = e.Code0A09 + "04"
+	ECode0A0905 = e.Code0A09 + "05"
+	ECode0A0906 = e.Code0A09 + "06"
+)
+
+// SetUpstream sets the processes the process depends on, replacing any set before. After
+// a successful run of an upstream process, its downstream processes run in the same run
+// group, once all of their upstream processes in the group completed. If an upstream
+// process does not complete, its downstream processes are skipped in the group. Run does
+// not run a downstream process while the latest run of one of its upstream processes did
+// not complete. All the processes must be registered, and must not depend on themselves.
+func (p *Processor) SetUpstream(code string, upstreamCodeList ...string) (err error) {
+	if _, ok := p.runList[code]; !ok {
+		return e.N(ECode0A0901, fmt.Sprintf("process '%s' was not registered", code))
+	}
+
+	for _, upstreamCode := range upstreamCodeList {
+		if _, ok := p.runList[upstreamCode]; !ok {
+			return e.N(ECode0A0902,
+				fmt.Sprintf("upstream process '%s' was not registered", upstreamCode))
+		}
+
+		// The upstream process must not already depend on the process
+		if upstreamCode == code || processutil.IsUpstream(p.upstreamMap, code, upstreamCode) {
+			return e.N(ECode0A0903,
+				fmt.Sprintf("process '%s' depends on process '%s'", upstreamCode, code))
+		}
+	}
+
+	if p.upstreamMap == nil {
+		p.upstreamMap = make(map[string][]string, 1)
+	}
+	p.upstreamMap[code] = upstreamCodeList
+
+	return nil
+}
+
+// getBlockedReason returns why the process can not run if the latest run of any of its
+// upstream processes did not complete, or an empty string if it can run
+func (p *Processor) getBlockedReason(ctx context.Context, code string) (reason string, err error) {
+	for _, upstreamCode := range p.upstreamMap[code] {
+		pr, err := sqlmodel.ProcessRunGetLatest(ctx, p.db, p.runList[upstreamCode].process.ID)
+		if err != nil {
+			return "", e.W(err, ECode0A0904)
+		}
+
+		if pr == nil {
+			// It never ran, so it did not fail either
+			continue
+		}
+
+		switch pr.Status {
+		case model.ProcessRunStatusCompleted, model.ProcessRunStatusRunning:
+		default:
+			return fmt.Sprintf("process blocked by upstream process '%s' (%s)",
+				upstreamCode, pr.Status), nil
+		}
+	}
+
+	return "", nil
+}
+
+// runDownstream runs the processes downstream of the code, in dependency order, in the run
+// group. A downstream process is skipped, recording a skipped run in the group, if any of its
+// upstream processes in the group did not complete.
+func (p *Processor) runDownstream(ctx context.Context, code string, groupID int,
+	completed bool) (rrList []*RunResponse) {
+	statusMap := map[string]bool{code: completed}
+	for _, downstreamCode := range processutil.GetDownstreamList(p.upstreamMap, code) {
+		reason := ""
+		for _, upstreamCode := range p.upstreamMap[downstreamCode] {
+			if upstreamCompleted, ok := statusMap[upstreamCode]; ok && !upstreamCompleted {
+				reason = fmt.Sprintf("upstream process '%s' did not complete", upstreamCode)
+				break
+			}
+		}
+
+		var err error
+		rr := &RunResponse{
+			Skipped:    true,
+			SkipReason: reason,
+		}
+		if reason == "" {
+			rr, err = p.execute(ctx, downstreamCode, &runParam{groupID: groupID})
+			if err != nil {
+				log.Error().Err(e.W(err, ECode0A0905)).Msg("[Processor.runDownstream]")
+			}
+		}
+
+		if rr == nil {
+			statusMap[downstreamCode] = false
+			continue
+		}
+
+		// Only a completed run lets the processes downstream of it run
+		statusMap[downstreamCode] = err == nil && !rr.Skipped
+
+		if rr.Skipped && rr.Run == nil {
+			// Record the skipped run, so the run group shows why the process did not run
+			pr, err := sqlmodel.ProcessRunSkip(ctx, p.db, p.runList[downstreamCode].process.ID,
+				groupID, rr.SkipReason)
+			if err != nil {
+				log.Warn().Err(e.W(err, ECode0A0906)).Msg("[Processor.runDownstream]")
+			}
+			rr.Run = pr
+		}
+
+		rrList = append(rrList, rr)
+	}
+
+	return rrList
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	"github.com/Skyrin/go-lib/e"
 	"github.com/Skyrin/go-lib/processpgx/model"
 	sql "github.com/Skyrin/go-lib/sqlpgx"
@@ -33,6 +34,17 @@ const (
 	ECode0A020F_lock_alreadyRunning = e.Code0A02 + "0F"
 	ECode0A020G_lock_statusInactive = e.Code0A02 + "0G"
 	ECode0A020H_lock_notReady       = e.Code0A02 + "0H"
+	ECode0A020I                     = e.Code0A02 + "0I"
+	ECode0A020J                     = e.Code0A02 + "0J"
+	ECode0A020K                     = e.Code0A02 + "0K"
+	ECode0A020L                     = e.Code0A02 + "0L"
+	ECode0A020M                     = e.Code0A02 + "0M"
+	ECode0A020N_renewLease_lost     = e.Code0A02 + "0N"
+	ECode0A020O                     = e.Code0A02 + "0O"
+	ECode0A020P                     = e.Code0A02 + "0P"
+	ECode0A020Q                     = e.Code0A02 + "0Q"
+	ECode0A020R                     = e.Code0A02 + "0R"
+	ECode0A020S                     = e.Code0A02 + "0S"
 )
 
 // ProcessGetParam get params
@@ -41,21 +53,31 @@ type ProcessGetParam struct {
 	Offset               int
 	ID                   *int
 	Code                 *string
+	CodeList             []string
 	FlagCount            bool
 	OrderByID            string
 	ForNoKeyUpdateNoWait bool
 	Status               string
 	IsNextRunTime        bool
+	IsScheduled          bool
+	IsLeaseFree          bool
 }
 
 // ProcessUpsert upsert a record into the process table
 func ProcessUpsert(ctx context.Context, db *sql.Connection, p *model.Process) (id int, err error) {
+	var nextRunTime interface{} = p.NextRunTime
+	if p.Schedule != "" {
+		nextRunTime = getRunTimeExpr(p.NextRunTime)
+	}
+
 	sb := db.Insert(ProcessTable).
 		Columns("process_code", "process_name", "process_status",
 			"process_next_run_time", "process_interval",
+			"process_schedule", "process_time_zone",
 			"process_message", "created_on", "updated_on").
 		Values(p.Code, p.Name, model.ProcessStatusActive,
-			p.NextRunTime, p.Interval,
+			nextRunTime, p.Interval,
+			p.Schedule, p.TimeZone,
 			"", "now()", "now()").
 		Suffix(`ON CONFLICT ON CONSTRAINT process__ukey DO UPDATE
 		SET process_name=excluded.process_name, updated_on=now()
@@ -73,6 +95,12 @@ func ProcessUpsert(ctx context.Context, db *sql.Connection, p *model.Process) (i
 func ProcessGet(ctx context.Context, db *sql.Connection, p *ProcessGetParam) (pList []*model.Process, count int, err error) {
 	fields := `process_id, process_code, process_name, process_status,
 		process_last_run_time, process_next_run_time, EXTRACT(EPOCH FROM process_interval)::INTEGER,
+		process_schedule, process_time_zone,
+		process_lease_owner, process_lease_until, COALESCE(process_lease_run_id, 0),
+		EXTRACT(EPOCH FROM process_max_run_time)::INTEGER,
+		process_retry_max_attempts, EXTRACT(MICROSECONDS FROM process_retry_backoff)::BIGINT,
+		EXTRACT(MICROSECONDS FROM process_retry_max_backoff)::BIGINT, process_retry_jitter,
+		process_retry_attempt,
 		process_total_success, EXTRACT(MICROSECONDS FROM process_avg_run_time)::INTEGER,
 		process_message, created_on, updated_on`
 
@@ -92,6 +120,10 @@ func ProcessGet(ctx context.Context, db *sql.Connection, p *ProcessGetParam) (pL
 		sb = sb.Where("process_code = ?", *p.Code)
 	}
 
+	if len(p.CodeList) > 0 {
+		sb = sb.Where(sq.Eq{"process_code": p.CodeList})
+	}
+
 	if p.Status != "" {
 		sb = sb.Where("process_status=?", p.Status)
 	}
@@ -102,6 +134,14 @@ func ProcessGet(ctx context.Context, db *sql.Connection, p *ProcessGetParam) (pL
 		sb = sb.Where("process_next_run_time<NOW()")
 	}
 
+	if p.IsScheduled {
+		sb = sb.Where("(process_interval>MAKE_INTERVAL(secs => 0) OR process_schedule<>'')")
+	}
+
+	if p.IsLeaseFree {
+		sb = sb.Where("(process_lease_until IS NULL OR process_lease_until<NOW())")
+	}
+
 	if p.FlagCount {
 		// Get the count before applying an offset if there is one
 		count, err = db.QueryCount(ctx, sb)
@@ -130,22 +170,36 @@ func ProcessGet(ctx context.Context, db *sql.Connection, p *ProcessGetParam) (pL
 	for rows.Next() {
 		d := &model.Process{}
 		lrt := &gosql.NullTime{}
+		lut := &gosql.NullTime{}
 		successCount := gosql.NullInt64{}
-		var interval, averageRunTime int64
+		var interval, maxRunTime, retryBackoff, retryMaxBackoff, averageRunTime int64
 		if err := rows.Scan(&d.ID, &d.Code, &d.Name, &d.Status,
 			lrt, &d.NextRunTime, &interval,
+			&d.Schedule, &d.TimeZone,
+			&d.LeaseOwner, lut, &d.LeaseRunID,
+			&maxRunTime,
+			&d.Retry.MaxAttempts, &retryBackoff,
+			&retryMaxBackoff, &d.Retry.Jitter,
+			&d.RetryAttempt,
 			&successCount, &averageRunTime,
 			&d.Message, &d.CreatedOn, &d.UpdatedOn); err != nil {
 			return nil, 0, e.W(err, ECode0A0204)
 		}
 
 		d.Interval = time.Duration(interval) * time.Second
+		d.MaxRunTime = time.Duration(maxRunTime) * time.Second
+		d.Retry.Backoff = time.Duration(retryBackoff) * time.Microsecond
+		d.Retry.MaxBackoff = time.Duration(retryMaxBackoff) * time.Microsecond
 		d.AverageRunTime = time.Duration(averageRunTime) * time.Microsecond // Average run time is extracted as micro seconds
 
 		if lrt.Valid {
 			d.LastRunTime = lrt.Time
 		}
 
+		if lut.Valid {
+			d.LeaseUntil = lut.Time
+		}
+
 		if successCount.Valid {
 			d.SuccessCount = int(successCount.Int64)
 		}
@@ -172,6 +226,24 @@ func ProcessGetByCode(ctx context.Context, db *sql.Connection, code string) (p *
 	return pList[0], nil
 }
 
+// ProcessGetDue returns the active processes of the codes that have an interval or
+// schedule, are past their next run time and are not leased by a running instance
+func ProcessGetDue(ctx context.Context, db *sql.Connection, codeList []string) (pList []*model.Process, err error) {
+	pList, _, err = ProcessGet(ctx, db, &ProcessGetParam{
+		Limit:         len(codeList),
+		CodeList:      codeList,
+		Status:        model.ProcessStatusActive,
+		IsNextRunTime: true,
+		IsScheduled:   true,
+		IsLeaseFree:   true,
+	})
+	if err != nil {
+		return nil, e.W(err, ECode0A020I)
+	}
+
+	return pList, nil
+}
+
 // ProcessGetByID returns the process record with the specified id
 func ProcessGetByID(ctx context.Context, db *sql.Connection, id int) (p *model.Process, err error) {
 	pList, _, err := ProcessGet(ctx, db, &ProcessGetParam{
@@ -190,15 +262,17 @@ func ProcessGetByID(ctx context.Context, db *sql.Connection, id int) (p *model.P
 
 // ProcessLock attempts to establish a lock on the specified process. The process will be skipped
 // in the following scenarios:
-// 1. The process is already running (the row is already locked)
+// 1. The process is already running (the row is already locked or its lease has not expired)
 // 2. The process is no longer active
-// 3. The process has an interval and it is not currently past the process's next run time
-func ProcessLock(ctx context.Context, db *sql.Connection, id int) (p *model.Process, err error) {
+// 3. The process has an interval and it is not currently past the process's next run time,
+// unless the next run time is ignored, e.g. the run was triggered by an upstream process
+func ProcessLock(ctx context.Context, db *sql.Connection, id int, ignoreNextRunTime bool) (p *model.Process, err error) {
 	pList, _, err := ProcessGet(ctx, db, &ProcessGetParam{
 		ID:                   &id,
 		ForNoKeyUpdateNoWait: true,
 		Status:               model.ProcessStatusActive,
-		IsNextRunTime:        true,
+		IsNextRunTime:        !ignoreNextRunTime,
+		IsLeaseFree:          true,
 	})
 	if err != nil {
 		// Special case if failed due to FOR NO KEY UPDATE NOWAIT
@@ -221,6 +295,20 @@ func ProcessLock(ctx context.Context, db *sql.Connection, id int) (p *model.Proc
 			return nil, e.N(ECode0A020G_lock_statusInactive, "process is inactive")
 		}
 
+		// Check if another instance holds the lease
+		pList, _, err = ProcessGet(ctx, db, &ProcessGetParam{
+			ID:          &id,
+			IsLeaseFree: true,
+		})
+		if err != nil {
+			return nil, e.W(err, ECode0A020L)
+		}
+
+		if len(pList) == 0 {
+			return nil, e.N(ECode0A020F_lock_alreadyRunning,
+				fmt.Sprintf("process lease held by '%s'", p.LeaseOwner))
+		}
+
 		// Otherwise, it should have failed because it is not time to run it yet
 		return nil, e.N(ECode0A020H_lock_notReady, "process not ready to run")
 	}
@@ -268,10 +356,157 @@ func ProcessSetRunTime(ctx context.Context, db *sql.Connection, id int) (err err
 	return nil
 }
 
+// ProcessSetScheduledRunTime sets the process's last run time as now and the next run
+// time as the next time of its schedule
+func ProcessSetScheduledRunTime(ctx context.Context, db *sql.Connection, id int, nextRunTime time.Time) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_last_run_time", db.Expr("NOW()")).
+		Set("process_next_run_time", getRunTimeExpr(nextRunTime)).
+		Where("process_id=?", id)
+
+	if err := db.ExecUpdate(ctx, ub); err != nil {
+		return e.W(err, ECode0A020J, fmt.Sprintf("id: %d", id))
+	}
+
+	return nil
+}
+
+// ProcessSetSchedule updates the schedule of the process and sets its next run time
+func ProcessSetSchedule(ctx context.Context, db *sql.Connection, id int, schedule, timeZone string,
+	nextRunTime time.Time) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_schedule", schedule).
+		Set("process_time_zone", timeZone).
+		Set("process_next_run_time", getRunTimeExpr(nextRunTime)).
+		Set("updated_on", db.Expr("NOW()")).
+		Where("process_id=?", id)
+
+	if err := db.ExecUpdate(ctx, ub); err != nil {
+		return e.W(err, ECode0A020K, fmt.Sprintf("id: %d, schedule: %s, tz: %s",
+			id, schedule, timeZone))
+	}
+
+	return nil
+}
+
+// ProcessSetLease gives the lease on the process to the owner for the duration, along
+// with the run it is for
+func ProcessSetLease(ctx context.Context, db *sql.Connection, id int, owner string, runID int,
+	lease time.Duration) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_lease_owner", owner).
+		Set("process_lease_until", db.Expr("NOW() + MAKE_INTERVAL(secs => ?)", lease.Seconds())).
+		Set("process_lease_run_id", runID).
+		Where("process_id=?", id)
+
+	if err := db.ExecUpdate(ctx, ub); err != nil {
+		return e.W(err, ECode0A020M, fmt.Sprintf("id: %d, owner: %s", id, owner))
+	}
+
+	return nil
+}
+
+// ProcessRenewLease extends the owner's lease on the process by the duration. Returns
+// ECode0A020N_renewLease_lost if the owner no longer holds the lease.
+func ProcessRenewLease(ctx context.Context, db *sql.Connection, id int, owner string,
+	lease time.Duration) (err error) {
+	stmt := `UPDATE process
+		SET process_lease_until=NOW() + MAKE_INTERVAL(secs => $1)
+		WHERE process_id=$2 AND process_lease_owner=$3
+		RETURNING process_id`
+
+	if err := db.QueryRow(ctx, stmt, lease.Seconds(), id, owner).Scan(&id); err != nil {
+		if sql.IsNoRowsError(err) {
+			return e.N(ECode0A020N_renewLease_lost,
+				fmt.Sprintf("process lease lost, id: %d, owner: %s", id, owner))
+		}
+		return e.W(err, ECode0A020O, fmt.Sprintf("id: %d, owner: %s", id, owner))
+	}
+
+	return nil
+}
+
+// ProcessReleaseLease releases the owner's lease on the process, if it still holds it
+func ProcessReleaseLease(ctx context.Context, db *sql.Connection, id int, owner string) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_lease_owner", "").
+		Set("process_lease_until", nil).
+		Set("process_lease_run_id", nil).
+		Where("process_id=? AND process_lease_owner=?", id, owner)
+
+	if err := db.ExecUpdate(ctx, ub); err != nil {
+		return e.W(err, ECode0A020P, fmt.Sprintf("id: %d, owner: %s", id, owner))
+	}
+
+	return nil
+}
+
+// ProcessSetMaxRunTime update the max time a run of the process may take, 0 for no limit
+func ProcessSetMaxRunTime(ctx context.Context, db *sql.Connection, id int, maxRunTime time.Duration) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_max_run_time", db.Expr("MAKE_INTERVAL(secs => ?)", maxRunTime.Seconds())).
+		Where("process_id=?", id)
+
+	if err := db.ExecUpdate(ctx, ub); err != nil {
+		return e.W(err, ECode0A020Q, fmt.Sprintf("id: %d, maxRunTime: %s", id, maxRunTime))
+	}
+
+	return nil
+}
+
+// ProcessSetRetryPolicy update the retry policy of the process
+func ProcessSetRetryPolicy(ctx context.Context, db *sql.Connection, id int, rp *model.RetryPolicy) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_retry_max_attempts", rp.MaxAttempts).
+		Set("process_retry_backoff", db.Expr("MAKE_INTERVAL(secs => ?)", rp.Backoff.Seconds())).
+		Set("process_retry_max_backoff", db.Expr("MAKE_INTERVAL(secs => ?)", rp.MaxBackoff.Seconds())).
+		Set("process_retry_jitter", rp.Jitter).
+		Where("process_id=?", id)
+
+	if err := db.ExecUpdate(ctx, ub); err != nil {
+		return e.W(err, ECode0A020R, fmt.Sprintf("id: %d", id))
+	}
+
+	return nil
+}
+
+// ProcessSetRetryAttempt sets the count of consecutive failed runs that were retried. If the
+// retry time is not zero, the next run time is moved up to it, unless it is already sooner.
+func ProcessSetRetryAttempt(ctx context.Context, db *sql.Connection, id, attempt int, retryTime time.Time) (err error) {
+	ub := db.Update(ProcessTable).
+		Set("process_retry_attempt", attempt).
+		Where("process_id=?", id)
+
+	if !retryTime.IsZero() {
+		ub = ub.Set("process_next_run_time",
+			db.Expr("LEAST(process_next_run_time, TO_TIMESTAMP(?)::TIMESTAMP)", float64(retryTime.Unix())))
+	}
+
+	if err := db.ExecUpdate(ctx, ub); err != nil {
+		return e.W(err, ECode0A020S, fmt.Sprintf("id: %d, attempt: %d", id, attempt))
+	}
+
+	return nil
+}
+
+// getRunTimeExpr returns the expression to store the run time in a timestamp column. The
+// timestamp is converted by the DB, so it compares correctly with NOW() regardless of the
+// session time zone. The zero time is stored as the last day supported, i.e. never, as
+// infinity can not be scanned into a time.
+func getRunTimeExpr(t time.Time) sq.Sqlizer {
+	if t.IsZero() {
+		return sq.Expr("'9999-12-31'::TIMESTAMP")
+	}
+
+	return sq.Expr("TO_TIMESTAMP(?)::TIMESTAMP", float64(t.Unix()))
+}
+
 // ProcessSetLastSuccess sets the process's last successful run time as now and updates the process success
 // statistics, which include:
 //  1. The total number of successful runs
 //  2. The average run time
+//
+// It also resets the count of consecutive failed runs that were retried.
 func ProcessSetLastSuccess(ctx context.Context, db *sql.Connection, id int, runTime time.Duration) (err error) {
 	const setAvgRunTime = `MAKE_INTERVAL(secs =>
 		(COALESCE(EXTRACT(EPOCH FROM process_avg_run_time), 0) * COALESCE(process_total_success,0) + ?)
@@ -283,6 +518,7 @@ func ProcessSetLastSuccess(ctx context.Context, db *sql.Connection, id int, runT
 		Set("process_total_success", db.Expr("COALESCE(process_total_success, 0) + 1")).
 		Set("process_avg_run_time",
 			db.Expr(setAvgRunTime, runTime.Seconds())).
+		Set("process_retry_attempt", 0).
 		Where("process_id=?", id)
 
 	if err := db.ExecUpdate(ctx, ub); err != nil {
@@ -0,0 +1,114 @@
+package sqlmodel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/processpgx/model"
+	sql "github.com/Skyrin/go-lib/sqlpgx"
+)
+
+const (
+	// ProcessRequestTable
+	ProcessRequestTable = "process_request"
+
+	ECode0A0B01 = e.Code0A0B + "01"
+	ECode0A0B02 = e.Code0A0B + "02"
+	ECode0A0B03 = e.Code0A0B + "03"
+	ECode0A0B04 = e.Code0A0B + "04"
+	ECode0A0B05 = e.Code0A0B + "05"
+)
+
+// ProcessRequestCreate inserts a new record
+func ProcessRequestCreate(ctx context.Context, db *sql.Connection, code string, params json.RawMessage) (id int, err error) {
+	if len(params) == 0 {
+		params = json.RawMessage("{}")
+	}
+
+	ib := db.Insert(ProcessRequestTable).
+		Columns("process_code", "process_request_params", "created_on").
+		Values(code, db.Expr("?::JSONB", string(params)), db.Expr("NOW()")).
+		Suffix("RETURNING process_request_id")
+
+	id, err = db.ExecInsertReturningID(ctx, ib)
+	if err != nil {
+		return 0, e.W(err, ECode0A0B01, fmt.Sprintf("code: %s", code))
+	}
+
+	return id, nil
+}
+
+// ProcessRequestClaim claims the oldest pending record of any of the codes for the owner
+// and returns it, or nil if there is none. A record is pending until a run is set for it,
+// see ProcessRequestSetRun. A record claimed longer than the claim timeout ago without a
+// run can be claimed again, as the owner must have stopped before it started the run.
+func ProcessRequestClaim(ctx context.Context, db *sql.Connection, codeList []string, owner string,
+	claimTimeout time.Duration) (pr *model.ProcessRequest, err error) {
+	sb := db.Select("process_request_id").
+		From(ProcessRequestTable).
+		Where(sq.Eq{"process_code": codeList}).
+		Where(`process_run_id IS NULL AND (process_request_claimed_on IS NULL
+			OR process_request_claimed_on<NOW() - MAKE_INTERVAL(secs => ?))`, claimTimeout.Seconds()).
+		OrderBy("process_request_id").
+		Limit(1).
+		Suffix("FOR UPDATE SKIP LOCKED").
+		// Numbered by the update it is nested in
+		PlaceholderFormat(sq.Question)
+
+	ub := db.Update(ProcessRequestTable).
+		Set("process_request_owner", owner).
+		Set("process_request_claimed_on", db.Expr("NOW()")).
+		Where(sq.Expr("process_request_id=(?)", sb)).
+		Suffix(`RETURNING process_request_id, process_code, process_request_params::TEXT,
+			process_request_owner, process_request_claimed_on, created_on`)
+
+	stmt, args, err := ub.ToSql()
+	if err != nil {
+		return nil, e.W(err, ECode0A0B02)
+	}
+
+	pr = &model.ProcessRequest{}
+	var params string
+	if err := db.QueryRow(ctx, stmt, args...).Scan(&pr.ID, &pr.Code, &params,
+		&pr.Owner, &pr.ClaimedOn, &pr.CreatedOn); err != nil {
+		if sql.IsNoRowsError(err) {
+			return nil, nil
+		}
+		return nil, e.W(err, ECode0A0B03, fmt.Sprintf("owner: %s", owner))
+	}
+	pr.Params = json.RawMessage(params)
+
+	return pr, nil
+}
+
+// ProcessRequestSetRun sets the run started for the record, which is no longer pending
+func ProcessRequestSetRun(ctx context.Context, db *sql.Connection, id, runID int) (err error) {
+	ub := db.Update(ProcessRequestTable).
+		Set("process_run_id", runID).
+		Where("process_request_id=?", id)
+
+	if err := db.ExecUpdate(ctx, ub); err != nil {
+		return e.W(err, ECode0A0B04, fmt.Sprintf("id: %d, runID: %d", id, runID))
+	}
+
+	return nil
+}
+
+// ProcessRequestRelease releases the owner's claim on the record, if it still holds it, so
+// it can be claimed again
+func ProcessRequestRelease(ctx context.Context, db *sql.Connection, id int, owner string) (err error) {
+	ub := db.Update(ProcessRequestTable).
+		Set("process_request_owner", "").
+		Set("process_request_claimed_on", nil).
+		Where("process_request_id=? AND process_request_owner=? AND process_run_id IS NULL", id, owner)
+
+	if err := db.ExecUpdate(ctx, ub); err != nil {
+		return e.W(err, ECode0A0B05, fmt.Sprintf("id: %d, owner: %s", id, owner))
+	}
+
+	return nil
+}
@@ -2,13 +2,17 @@ package processpgx
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Skyrin/go-lib/e"
 	"github.com/Skyrin/go-lib/processpgx/internal/sqlmodel"
 	"github.com/Skyrin/go-lib/processpgx/model"
 	sql "github.com/Skyrin/go-lib/sqlpgx"
+	"github.com/lib/pq"
 	"github.com/rs/zerolog/log"
 )
 
@@ -31,31 +35,104 @@ const (
 	ECode0A010G = e.Code0A01 + "0G"
 	ECode0A010H = e.Code0A01 + "0H"
 	ECode0A010I = e.Code0A01 + "0I"
+	ECode0A010J = e.Code0A01 + "0J"
+	ECode0A010K = e.Code0A01 + "0K"
+	ECode0A010L = e.Code0A01 + "0L"
+	ECode0A010M = e.Code0A01 + "0M"
+	ECode0A010N = e.Code0A01 + "0N"
+	ECode0A010O = e.Code0A01 + "0O"
+	ECode0A010P = e.Code0A01 + "0P"
+	ECode0A010Q = e.Code0A01 + "0Q"
+	ECode0A010R = e.Code0A01 + "0R"
+	ECode0A010S = e.Code0A01 + "0S"
+	ECode0A010T = e.Code0A01 + "0T"
+	ECode0A010U = e.Code0A01 + "0U"
+	ECode0A010V = e.Code0A01 + "0V"
+	ECode0A010W = e.Code0A01 + "0W"
+	ECode0A010X = e.Code0A01 + "0X"
+	ECode0A010Y = e.Code0A01 + "0Y"
+	ECode0A010Z = e.Code0A01 + "0Z"
+	ECode0A0110 = e.Code0A01 + "10"
+	ECode0A0111 = e.Code0A01 + "11"
+	ECode0A0112 = e.Code0A01 + "12"
 )
 
 // Processor is used to create a singleton process. It ensures only
 // one process is running at a time.
 type Processor struct {
-	db      *sql.Connection
-	runList map[string]*run
+	db            *sql.Connection
+	runList       map[string]*run
+	owner         string          // Identifies this processor as the owner of a lease
+	leaseDuration time.Duration   // How long a lease lasts without being renewed
+	pollInterval  time.Duration   // How often Start checks for due processes
+	started       bool            // Whether Start is running
+	runningMap    map[string]bool // Processes started by Start that are still running
+	ctx           context.Context // Parent of the ctx passed to each run
+	cancel        context.CancelFunc
+	alertHook     func(ri *RunInfo, err error) // Called after the final failed run of a process
+	upstreamMap   map[string][]string          // Upstream process codes of each process code
+	listener      *pq.Listener                 // Notified of new requests, see ListenForRequests
+	wg            sync.WaitGroup
+	mutex         sync.Mutex
 }
 
 // RunResponse the response returned after running a process
 type RunResponse struct {
-	Skipped    bool              // Indicates if skipped
-	SkipReason string            // Indicates why it was skipped
-	Run        *model.ProcessRun // The run itself
+	Skipped        bool              // Indicates if skipped
+	SkipReason     string            // Indicates why it was skipped
+	Run            *model.ProcessRun // The run itself
+	DownstreamList []*RunResponse    // Runs of the downstream processes in the same run group
+}
+
+// RunInfo details of the run passed to a process registered with RegisterCtx
+type RunInfo struct {
+	Process *model.Process    // The process as it was when the run started
+	Run     *model.ProcessRun // The run itself
+	Params  json.RawMessage   // Params of the request the run was started for, see Request
+	Result  interface{}       // Set by the run func to store it as JSON with the run
+}
+
+// runParam optional params of a run
+type runParam struct {
+	groupID int                   // Run group of the upstream run that triggered it
+	request *model.ProcessRequest // Request it was started for
 }
 
 type run struct {
-	process *model.Process
-	f       func() error
+	process  *model.Process
+	schedule *Schedule
+	f        func(ctx context.Context, ri *RunInfo) error
 }
 
 // NewDataProcess returns a new instance of a processor
 func NewProcessor(db *sql.Connection) (p *Processor) {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Processor{
-		db: db,
+		db:            db,
+		owner:         getOwner(),
+		leaseDuration: DefaultLeaseDuration,
+		pollInterval:  DefaultPollInterval,
+		runningMap:    map[string]bool{},
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// Shutdown cancels the ctx of every in-flight run of a process registered with RegisterCtx.
+// Those runs are recorded as failed, unless they still complete. Runs started after
+// Shutdown are cancelled immediately. It also stops listening for requests.
+func (p *Processor) Shutdown() {
+	p.cancel()
+
+	p.mutex.Lock()
+	listener := p.listener
+	p.mutex.Unlock()
+
+	if listener != nil {
+		if err := listener.Close(); err != nil {
+			log.Warn().Err(e.W(err, ECode0A010W)).Msg("[Processor.Shutdown]")
+		}
 	}
 }
 
@@ -65,37 +142,108 @@ func NewProcessor(db *sql.Connection) (p *Processor) {
 // trying to call them.
 //
 // The run function will be invoked when the process is called later. It
-// creates a lock on the process (in the database) to ensure only one
-// can run at a time.The run func should define all data processing that
+// takes a lease on the process (in the database) to ensure only one
+// can run at a time. The run func should define all data processing that
 // needs to occur for this run.
 func (p *Processor) Register(ctx context.Context, code, name string, f func() error) (err error) {
-	if err := p.register(ctx, code, name, nil, f); err != nil {
+	if err := p.register(ctx, code, name, nil, nil, wrapFunc(f)); err != nil {
 		return e.W(err, ECode0A010C)
 	}
 
 	return nil
 }
 
+// RegisterCtx will register the process, see Register. The run function is passed the
+// details of the run and a ctx that is cancelled when the processor is shut down, see
+// Shutdown, once the run takes longer than the process's max run time, see SetMaxRunTime,
+// or if the run loses its lease, see SetLeaseDuration. A run cancelled by the max run time
+// is recorded with the timeout status.
+func (p *Processor) RegisterCtx(ctx context.Context, code, name string,
+	f func(ctx context.Context, ri *RunInfo) error) (err error) {
+	if err := p.register(ctx, code, name, nil, nil, f); err != nil {
+		return e.W(err, ECode0A010R)
+	}
+
+	return nil
+}
+
 // RegisterWithInterval will register the process with the specified interval.
 // If the process is already registered, it will return an error. If the process
 // does not exist, it will create it. The application using this package should
 // register all processes on start to ensure they exist before trying to call them.
 //
 // The run function will be invoked when the process is called later. It
-// creates a lock on the process (in the database) to ensure only one
+// takes a lease on the process (in the database) to ensure only one
 // can run at a time. The run func should define all data processing that
 // needs to occur for this process.
 func (p *Processor) RegisterWithInterval(ctx context.Context, code, name string, interval time.Duration, f func() error) (err error) {
-	if err := p.register(ctx, code, name, &interval, f); err != nil {
+	if err := p.register(ctx, code, name, &interval, nil, wrapFunc(f)); err != nil {
 		return e.W(err, ECode0A010H)
 	}
 
 	return nil
 }
 
+// RegisterWithIntervalCtx will register the process with the specified interval, see
+// RegisterWithInterval. The run function is passed the details of the run and a ctx, see
+// RegisterCtx.
+func (p *Processor) RegisterWithIntervalCtx(ctx context.Context, code, name string, interval time.Duration,
+	f func(ctx context.Context, ri *RunInfo) error) (err error) {
+	if err := p.register(ctx, code, name, &interval, nil, f); err != nil {
+		return e.W(err, ECode0A0110)
+	}
+
+	return nil
+}
+
+// RegisterWithSchedule will register the process to run on the cron schedule in the time
+// zone, see ParseSchedule, skipping run times in any of the blackout windows. If the
+// process does not exist, it will create it. If it exists with a different schedule, the
+// schedule and next run time are updated. The application using this package should
+// register all processes on start to ensure they exist before trying to call them.
+//
+// The run function will be invoked when the process is called later, see Register.
+func (p *Processor) RegisterWithSchedule(ctx context.Context, code, name, cronExpr, tz string, f func() error,
+	blackoutList ...*Blackout) (err error) {
+	if err := p.RegisterWithScheduleCtx(ctx, code, name, cronExpr, tz, wrapFunc(f),
+		blackoutList...); err != nil {
+		return e.W(err, ECode0A0111)
+	}
+
+	return nil
+}
+
+// RegisterWithScheduleCtx will register the process to run on the cron schedule in the
+// time zone, see RegisterWithSchedule. The run function is passed the details of the run
+// and a ctx, see RegisterCtx.
+func (p *Processor) RegisterWithScheduleCtx(ctx context.Context, code, name, cronExpr, tz string,
+	f func(ctx context.Context, ri *RunInfo) error, blackoutList ...*Blackout) (err error) {
+	s, err := ParseSchedule(cronExpr, tz)
+	if err != nil {
+		return e.W(err, ECode0A010J)
+	}
+
+	for _, b := range blackoutList {
+		if err := s.AddBlackout(b); err != nil {
+			return e.W(err, ECode0A010K)
+		}
+	}
+
+	if s.Next(time.Now()).IsZero() {
+		return e.N(ECode0A010L, fmt.Sprintf("schedule '%s' never runs", cronExpr))
+	}
+
+	if err := p.register(ctx, code, name, nil, s, f); err != nil {
+		return e.W(err, ECode0A010M)
+	}
+
+	return nil
+}
+
 // register internal function to register a processor. Handles checking if the process already
 // exists and creating it if it does not exist
-func (p *Processor) register(ctx context.Context, code, name string, interval *time.Duration, f func() error) (err error) {
+func (p *Processor) register(ctx context.Context, code, name string, interval *time.Duration, s *Schedule,
+	f func(ctx context.Context, ri *RunInfo) error) (err error) {
 	// Only allow registering a code once
 	if _, ok := p.runList[code]; ok {
 		return e.N(ECode0A0101,
@@ -121,11 +269,26 @@ func (p *Processor) register(ctx context.Context, code, name string, interval *t
 			mp.Interval = *interval
 		}
 
+		if s != nil {
+			mp.Schedule = s.String()
+			mp.TimeZone = s.Location().String()
+			mp.NextRunTime = s.Next(time.Now())
+		}
+
 		id, err = sqlmodel.ProcessUpsert(ctx, p.db, mp)
 		if err != nil {
 			return e.W(err, ECode0A0102)
 		}
 		mp.ID = id
+	} else if s != nil && (mp.Schedule != s.String() || mp.TimeZone != s.Location().String()) {
+		// The schedule changed since the process was created
+		mp.Schedule = s.String()
+		mp.TimeZone = s.Location().String()
+		mp.NextRunTime = s.Next(time.Now())
+		if err := sqlmodel.ProcessSetSchedule(ctx, p.db, mp.ID, mp.Schedule, mp.TimeZone,
+			mp.NextRunTime); err != nil {
+			return e.W(err, ECode0A010N)
+		}
 	}
 
 	// Check if the process is active
@@ -134,8 +297,9 @@ func (p *Processor) register(ctx context.Context, code, name string, interval *t
 	}
 
 	r := &run{
-		process: mp,
-		f:       f,
+		process:  mp,
+		schedule: s,
+		f:        f,
 	}
 
 	if p.runList == nil {
@@ -162,26 +326,62 @@ func (p *Processor) Deregister(ctx context.Context, code string) (err error) {
 // Run executes the registered process. If it has not been registered, it
 // will return an error. It will return a response indicating if it was skipped.
 // If yes, it will include a reason. If no, it will include the run details.
+//
+// The process is locked only long enough to take a lease on it, which is renewed while
+// the process runs and released after. If the lease of a previous run expired, i.e. the
+// instance running it crashed, that run is marked as abandoned and this run takes over.
+//
+// If the process has upstream processes, see SetUpstream, it is skipped while the latest
+// run of any of them did not complete. Once the run finishes, the processes downstream of
+// it are run or skipped in the same run group, see runDownstream.
 func (p *Processor) Run(ctx context.Context, code string) (rr *RunResponse, err error) {
+	rr, err = p.execute(ctx, code, &runParam{})
+	if rr == nil || rr.Run == nil {
+		return rr, err
+	}
+
+	rr.DownstreamList = p.runDownstream(ctx, code, rr.Run.GroupID, err == nil)
+
+	return rr, err
+}
+
+// execute executes the registered process, see Run. If the run param has a group id, the
+// run was triggered by an upstream process and is part of its run group. Otherwise, the
+// run starts a new run group. A run triggered by an upstream process or started for a
+// request does not wait for the process's next run time, and does not change its previous
+// and next run times, so the process keeps its regular cadence.
+func (p *Processor) execute(ctx context.Context, code string, rp *runParam) (rr *RunResponse, err error) {
 	r, ok := p.runList[code]
 	if !ok {
 		return nil, e.N(ECode0A0104,
 			fmt.Sprintf("process '%s' was not registered", code))
 	}
 
-	// Lock the process to this run
+	rr = &RunResponse{
+		Skipped: false,
+	}
+
+	// Check the upstream processes completed
+	rr.SkipReason, err = p.getBlockedReason(ctx, code)
+	if err != nil {
+		return nil, e.W(err, ECode0A010V)
+	}
+
+	if rr.SkipReason != "" {
+		rr.Skipped = true
+		return rr, nil
+	}
+
+	// Lock the process while taking the lease for this run
 	dbLock, err := p.db.BeginReturnDB(ctx)
 	if err != nil {
 		return nil, e.W(err, ECode0A0105)
 	}
 	defer dbLock.RollbackIfInTxn(ctx)
 
-	rr = &RunResponse{
-		Skipped: false,
-	}
-
 	// Establish the lock for this process record
-	proc, err := sqlmodel.ProcessLock(ctx, dbLock, r.process.ID)
+	onDemand := rp.groupID > 0 || rp.request != nil
+	proc, err := sqlmodel.ProcessLock(ctx, dbLock, r.process.ID, onDemand)
 	if err != nil {
 		switch true {
 		case e.ContainsError(err, sqlmodel.ECode0A020F_lock_alreadyRunning):
@@ -202,28 +402,98 @@ func (p *Processor) Run(ctx context.Context, code string) (rr *RunResponse, err
 		return nil, e.W(err, ECode0A0106)
 	}
 
-	// Set the previous and next run times if it has an interval
-	if proc.Interval > 0 {
+	// If the previous run's lease expired without being released, its instance is gone
+	if proc.LeaseRunID > 0 {
+		if err := sqlmodel.ProcessRunAbandon(ctx, dbLock, proc.LeaseRunID,
+			fmt.Sprintf("lease of '%s' expired", proc.LeaseOwner)); err != nil {
+			return nil, e.W(err, ECode0A010P)
+		}
+	}
+
+	// Set the previous and next run times if it has a schedule or an interval, unless it
+	// was run on demand
+	switch {
+	case onDemand:
+	case r.schedule != nil:
+		if err := sqlmodel.ProcessSetScheduledRunTime(ctx, dbLock, proc.ID,
+			r.schedule.Next(time.Now())); err != nil {
+			return nil, e.W(err, ECode0A010O)
+		}
+	case proc.Interval > 0:
 		if err := sqlmodel.ProcessSetRunTime(ctx, dbLock, proc.ID); err != nil {
 			return nil, e.W(err, ECode0A0107)
 		}
 	}
 
 	// Create a new process run record
-	rr.Run, err = sqlmodel.ProcessRunCreate(ctx, p.db, proc.ID)
+	rr.Run, err = sqlmodel.ProcessRunCreate(ctx, dbLock, proc.ID, rp.groupID)
 	if err != nil {
 		return nil, e.W(err, ECode0A0108)
 	}
 
-	// Track the run time
+	// Link the request to the run, so it is no longer pending
+	if rp.request != nil {
+		if err := sqlmodel.ProcessRequestSetRun(ctx, dbLock, rp.request.ID, rr.Run.ID); err != nil {
+			return nil, e.W(err, ECode0A010X)
+		}
+	}
+
+	// Take the lease on the process for this run
+	if err := sqlmodel.ProcessSetLease(ctx, dbLock, proc.ID, p.owner, rr.Run.ID,
+		p.leaseDuration); err != nil {
+		return nil, e.W(err, ECode0A010Q)
+	}
+
+	// Release the lock on this process, the lease keeps other runs out
+	if err := dbLock.Commit(ctx); err != nil {
+		return nil, e.W(err, ECode0A010D)
+	}
+	defer p.releaseLease(ctx, proc.ID)
+
+	// The run is cancelled on shutdown, once it takes longer than the max run time or if
+	// it loses its lease
+	runCtx, cancel := p.newRunContext(ctx, proc.MaxRunTime)
+	defer cancel()
+
+	// Track the run time, renewing the lease until it finishes
 	now := time.Now()
-	if err := r.f(); err != nil {
+	ri := &RunInfo{
+		Process: proc,
+		Run:     rr.Run,
+	}
+	if rp.request != nil {
+		ri.Params = rp.request.Params
+	}
+	stop := p.heartbeat(ctx, proc.ID, cancel)
+	err = r.f(runCtx, ri)
+	stop()
+
+	// Store the result, if the run func set one
+	if ri.Result != nil {
+		p.setResult(ctx, ri)
+	}
+	if err != nil {
 		// Set the runtime
 		rr.Run.RunTime = time.Since(now)
+
+		// Retry the process sooner, or alert if it will not be
+		defer p.retry(ctx, ri, err)
+
+		if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+			// Set run status to timeout, ignore error for the same reason as failed below
+			if err2 := sqlmodel.ProcessRunTimeout(ctx, p.db, rr.Run.ID, err.Error(),
+				rr.Run.RunTime); err2 != nil {
+				log.Warn().Err(e.W(err2, ECode0A010S)).Msg("[Processor.execute]")
+			}
+
+			return rr, e.W(err, ECode0A010T,
+				fmt.Sprintf("max run time: %s", proc.MaxRunTime))
+		}
+
 		// Set run status to failed, ignore error as we can't do much if
 		// it fails and we want to return the originating error
 		if err2 := sqlmodel.ProcessRunFail(ctx, p.db, rr.Run.ID, err.Error(), rr.Run.RunTime); err2 != nil {
-			log.Warn().Err(e.W(err2, ECode0A0109))
+			log.Warn().Err(e.W(err2, ECode0A0109)).Msg("[Processor.execute]")
 		}
 
 		return rr, e.W(err, ECode0A010A)
@@ -239,16 +509,11 @@ func (p *Processor) Run(ctx context.Context, code string) (rr *RunResponse, err
 	}
 
 	// Set the processes last successful run time
-	if err := sqlmodel.ProcessSetLastSuccess(ctx, dbLock, proc.ID, rr.Run.RunTime); err != nil {
+	if err := sqlmodel.ProcessSetLastSuccess(ctx, p.db, proc.ID, rr.Run.RunTime); err != nil {
 		rr.Run.Error = err.Error()
 		return rr, e.W(err, ECode0A010I)
 	}
 
-	// Release the lock on this process
-	if err := dbLock.Commit(ctx); err != nil {
-		return nil, e.W(err, ECode0A010D)
-	}
-
 	return rr, nil
 }
 
@@ -261,3 +526,58 @@ func (p *Processor) SetRunInterval(ctx context.Context, code string, interval ti
 
 	return nil
 }
+
+// SetMaxRunTime sets how long a run of the process may take before its ctx is cancelled,
+// 0 for no limit. Only processes registered with RegisterCtx can be cancelled.
+func (p *Processor) SetMaxRunTime(ctx context.Context, code string, maxRunTime time.Duration) (err error) {
+	if _, ok := p.runList[code]; !ok {
+		return e.N(ECode0A0112, fmt.Sprintf("process '%s' was not registered", code))
+	}
+
+	if err := sqlmodel.ProcessSetMaxRunTime(ctx, p.db, p.runList[code].process.ID, maxRunTime); err != nil {
+		return e.W(err, ECode0A010U)
+	}
+
+	return nil
+}
+
+// newRunContext returns the ctx for a run, derived from ctx and also cancelled on shutdown
+// or after the max run time
+func (p *Processor) newRunContext(ctx context.Context, maxRunTime time.Duration) (
+	runCtx context.Context, cancel context.CancelFunc) {
+	if maxRunTime > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, maxRunTime)
+	} else {
+		runCtx, cancel = context.WithCancel(ctx)
+	}
+
+	// Also cancel it on shutdown
+	stop := context.AfterFunc(p.ctx, cancel)
+
+	return runCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// wrapFunc adapts a run function without a ctx to the one used by RegisterCtx
+func wrapFunc(f func() error) func(ctx context.Context, ri *RunInfo) error {
+	return func(ctx context.Context, ri *RunInfo) error {
+		return f()
+	}
+}
+
+// setResult stores the result set by the run func as JSON with the run
+func (p *Processor) setResult(ctx context.Context, ri *RunInfo) {
+	// The run itself is not affected if the result can not be stored
+	b, err := json.Marshal(ri.Result)
+	if err != nil {
+		log.Warn().Err(e.W(err, ECode0A010Y)).Msg("[Processor.setResult]")
+		return
+	}
+	ri.Run.Result = b
+
+	if err := sqlmodel.ProcessRunSetResult(ctx, p.db, ri.Run.ID, b); err != nil {
+		log.Warn().Err(e.W(err, ECode0A010Z)).Msg("[Processor.setResult]")
+	}
+}
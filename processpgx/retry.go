@@ -0,0 +1,91 @@
+package processpgx
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/internal/processutil"
+	"github.com/Skyrin/go-lib/processpgx/internal/sqlmodel"
+	"github.com/Skyrin/go-lib/processpgx/model"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ECode0A0801 = e.Code0A08 + "01"
+	ECode0A0802 = e.Code0A08 + "02"
+	ECode0A0803 = e.Code0A08 + "03"
+	ECode0A0804 = e.Code0A08 + "04"
+	ECode0A0805 = e.Code0A08 + "05"
+	ECode0A0806 = e.Code0A08 + "06"
+	ECode0A0807 = e.Code0A08 + "07"
+)
+
+// SetRetryPolicy sets how soon the process runs again after a failed run, including a run
+// that timed out. Each retry is scheduled after the backoff, doubled for every consecutive
+// failed run and limited to the max backoff, with up to the jitter fraction of it randomly
+// added or removed. A retry is never later than the regular next run time. Once the max
+// attempts fail, the process falls back to its regular cadence. Only processes with an
+// interval or schedule are retried, as on demand processes are only run with Run. A nil
+// retry policy clears the policy, so failed runs are no longer retried.
+func (p *Processor) SetRetryPolicy(ctx context.Context, code string, rp *model.RetryPolicy) (err error) {
+	r, ok := p.runList[code]
+	if !ok {
+		return e.N(ECode0A0807, fmt.Sprintf("process '%s' was not registered", code))
+	}
+
+	if rp == nil {
+		rp = &model.RetryPolicy{}
+	}
+
+	if rp.MaxAttempts < 0 {
+		return e.N(ECode0A0801, fmt.Sprintf("invalid max attempts: %d", rp.MaxAttempts))
+	}
+
+	if rp.MaxAttempts > 0 && rp.Backoff <= 0 {
+		return e.N(ECode0A0802, fmt.Sprintf("invalid backoff: %s", rp.Backoff))
+	}
+
+	if rp.Jitter < 0 || rp.Jitter > 1 {
+		return e.N(ECode0A0803, fmt.Sprintf("invalid jitter: %f", rp.Jitter))
+	}
+
+	if err := sqlmodel.ProcessSetRetryPolicy(ctx, p.db, r.process.ID, rp); err != nil {
+		return e.W(err, ECode0A0804)
+	}
+
+	return nil
+}
+
+// SetAlertHook sets the func called after the final failed run of a process, i.e. one that
+// will not be retried. It is passed the run and the error it failed with.
+func (p *Processor) SetAlertHook(f func(ri *RunInfo, err error)) {
+	p.alertHook = f
+}
+
+// retry schedules the next attempt of the process after the failed run, according to its
+// retry policy. If the run will not be retried, the count of retries is reset and the alert
+// hook is called instead.
+func (p *Processor) retry(ctx context.Context, ri *RunInfo, runErr error) {
+	proc := ri.Process
+	attempt := proc.RetryAttempt + 1
+	if (proc.Interval > 0 || proc.Schedule != "") && attempt <= proc.Retry.MaxAttempts {
+		retryTime := time.Now().Add(processutil.GetRetryDelay(proc.Retry.Backoff,
+			proc.Retry.MaxBackoff, proc.Retry.Jitter, attempt))
+		if err := sqlmodel.ProcessSetRetryAttempt(ctx, p.db, proc.ID, attempt, retryTime); err != nil {
+			log.Warn().Err(e.W(err, ECode0A0805)).Msg("[Processor.retry]")
+		}
+		return
+	}
+
+	if proc.RetryAttempt > 0 {
+		if err := sqlmodel.ProcessSetRetryAttempt(ctx, p.db, proc.ID, 0, time.Time{}); err != nil {
+			log.Warn().Err(e.W(err, ECode0A0806)).Msg("[Processor.retry]")
+		}
+	}
+
+	if p.alertHook != nil {
+		p.alertHook(ri, runErr)
+	}
+}
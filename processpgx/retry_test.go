@@ -0,0 +1,40 @@
+package processpgx
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/processpgx/model"
+)
+
+func TestSetRetryPolicyError(t *testing.T) {
+	p := NewProcessor(nil)
+	p.runList = map[string]*run{"sync": {process: &model.Process{ID: 1, Code: "sync"}}}
+
+	tests := []struct {
+		name string
+		code string
+		rp   *model.RetryPolicy
+		want string
+	}{
+		{"not registered", "missing", &model.RetryPolicy{}, ECode0A0807},
+		{"not registered nil policy", "missing", nil, ECode0A0807},
+		{"negative max attempts", "sync", &model.RetryPolicy{MaxAttempts: -1}, ECode0A0801},
+		{"no backoff", "sync", &model.RetryPolicy{MaxAttempts: 3}, ECode0A0802},
+		{"jitter above 1", "sync",
+			&model.RetryPolicy{MaxAttempts: 3, Backoff: time.Second, Jitter: 1.5}, ECode0A0803},
+		{"negative jitter", "sync",
+			&model.RetryPolicy{MaxAttempts: 3, Backoff: time.Second, Jitter: -0.1}, ECode0A0803},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.SetRetryPolicy(context.Background(), tt.code, tt.rp)
+			if err == nil || !e.ContainsError(err, tt.want) {
+				t.Errorf("SetRetryPolicy() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
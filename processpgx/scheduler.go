@@ -0,0 +1,159 @@
+package processpgx
+
+import (
+	"context"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/Skyrin/go-lib/processpgx/internal/sqlmodel"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultPollInterval how often Start checks for due processes by default
+	DefaultPollInterval = 10 * time.Second
+
+	ECode0A0501 = e.Code0A05 + "01"
+	ECode0A0502 = e.Code0A05 + "02"
+	ECode0A0503 = e.Code0A05 + "03"
+)
+
+// SetPollInterval sets how often Start checks for processes that are due to run. If the
+// interval is not positive, DefaultPollInterval is used instead.
+func (p *Processor) SetPollInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	p.pollInterval = interval
+}
+
+// Start runs the registered processes that have an interval or schedule whenever their
+// next run time is due, checking every poll interval, until ctx is cancelled. Other
+// processes are only run on demand with Run. Each due process runs in its own go routine
+// and takes the same lease as Run, so multiple instances can call Start and each run
+// only happens on one of them. Once ctx is cancelled, no new runs are started and Start
+// waits for the in-flight runs to finish before returning. Start also returns once the
+// processor is shut down, see Shutdown. All processes must be registered before calling
+// Start.
+//
+// Start also runs the pending requests of the registered processes, see Request, on each
+// poll and whenever it is notified of a new request, see ListenForRequests.
+func (p *Processor) Start(ctx context.Context) (err error) {
+	p.mutex.Lock()
+	if p.started {
+		p.mutex.Unlock()
+		return e.N(ECode0A0501, "processor already started")
+	}
+	p.started = true
+	listener := p.listener
+	p.mutex.Unlock()
+
+	defer func() {
+		p.wg.Wait()
+
+		p.mutex.Lock()
+		p.started = false
+		p.mutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(p.pollInterval)
+	defer ticker.Stop()
+
+	var notifyCh <-chan *pq.Notification
+	if listener != nil {
+		notifyCh = listener.Notify
+	}
+
+	for {
+		if err := p.runDue(ctx); err != nil {
+			// Keep polling, the DB may only be unavailable for a moment
+			log.Error().Err(err).Msg("[Processor.Start]")
+		}
+
+		if err := p.runRequests(ctx); err != nil {
+			log.Error().Err(e.W(err, ECode0A0503)).Msg("[Processor.Start]")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.ctx.Done():
+			// Shut down, no new runs can start
+			return nil
+		case <-ticker.C:
+		case _, ok := <-notifyCh:
+			// A request was inserted, or the listener reconnected and may have missed one
+			if !ok {
+				// The listener was closed, keep polling
+				notifyCh = nil
+			}
+		}
+	}
+}
+
+// runDue starts a go routine for each registered process that is due to run and is not
+// already running on this instance
+func (p *Processor) runDue(ctx context.Context) (err error) {
+	if len(p.runList) == 0 {
+		return nil
+	}
+
+	codeList := make([]string, 0, len(p.runList))
+	for code := range p.runList {
+		codeList = append(codeList, code)
+	}
+
+	pList, err := sqlmodel.ProcessGetDue(ctx, p.db, codeList)
+	if err != nil {
+		return e.W(err, ECode0A0502)
+	}
+
+	for _, proc := range pList {
+		if !p.claim(proc.Code) {
+			continue
+		}
+
+		p.wg.Add(1)
+		go func(code string) {
+			defer p.wg.Done()
+			defer p.release(code)
+
+			// In-flight runs finish on shutdown, so they must not be cancelled with ctx
+			rr, err := p.Run(context.WithoutCancel(ctx), code)
+			if err != nil {
+				log.Error().Err(err).Str("code", code).Msg("[Processor.runDue]")
+				return
+			}
+
+			if rr.Skipped {
+				log.Debug().Str("code", code).Str("reason", rr.SkipReason).
+					Msg("[Processor.runDue]")
+			}
+		}(proc.Code)
+	}
+
+	return nil
+}
+
+// claim marks the process as running on this instance, returning false if it already is
+func (p *Processor) claim(code string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.runningMap[code] {
+		return false
+	}
+	p.runningMap[code] = true
+
+	return true
+}
+
+// release marks the process as no longer running on this instance
+func (p *Processor) release(code string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.runningMap, code)
+}
@@ -0,0 +1,183 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/lib/pq"
+)
+
+func TestGetConnectFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ConnectFailure
+	}{
+		{"nil", nil, ConnectFailureNone},
+		{"invalid password", &pq.Error{Code: "28P01"}, ConnectFailureAuth},
+		{"invalid authorization", &pq.Error{Code: "28000"}, ConnectFailureAuth},
+		{"cannot connect now", &pq.Error{Code: "57P03"}, ConnectFailureUnreachable},
+		{"other pq error", &pq.Error{Code: "3D000"}, ConnectFailureUnknown},
+		{"dns", &net.DNSError{Err: "no such host", Name: "db"}, ConnectFailureDNS},
+		{"op error", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, ConnectFailureUnreachable},
+		{"refused", fmt.Errorf("dial: %w", syscall.ECONNREFUSED), ConnectFailureUnreachable},
+		{"extended auth", e.W(&pq.Error{Code: "28P01"}, "test"), ConnectFailureAuth},
+		{"extended dns", e.W(&net.DNSError{Name: "db"}, "test"), ConnectFailureDNS},
+		{"unknown", errors.New("unknown"), ConnectFailureUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetConnectFailure(tt.err); got != tt.want {
+				t.Errorf("GetConnectFailure() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	retry := &ConnectRetry{
+		MaxWait:         50 * time.Millisecond,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     5 * time.Millisecond,
+	}
+
+	tests := []struct {
+		name      string
+		retry     *ConnectRetry
+		err       error
+		wantCode  string
+		wantRetry bool
+	}{
+		{"no retry", nil, syscall.ECONNREFUSED, "", false},
+		{"auth", retry, &pq.Error{Code: "28P01"}, ECode020B01, false},
+		{"dns", retry, &net.DNSError{Name: "db"}, ECode020B02, true},
+		{"unreachable", retry, syscall.ECONNREFUSED, ECode020B02, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			start := time.Now()
+			err := connectWithRetry(context.Background(), tt.retry, func() error {
+				calls++
+				return tt.err
+			})
+			elapsed := time.Since(start)
+
+			if err == nil {
+				t.Fatal("connectWithRetry() error = nil")
+			}
+			if tt.wantCode != "" && !e.ContainsError(err, tt.wantCode) {
+				t.Errorf("connectWithRetry() error = %v, want %s", err, tt.wantCode)
+			}
+			if !tt.wantRetry {
+				if calls != 1 {
+					t.Errorf("calls = %d, want 1", calls)
+				}
+				return
+			}
+			if calls < 2 {
+				t.Errorf("calls = %d, want retries", calls)
+			}
+			if elapsed < tt.retry.MaxWait {
+				t.Errorf("gave up after %s, want at least %s", elapsed, tt.retry.MaxWait)
+			}
+		})
+	}
+}
+
+func TestConnectWithRetrySucceeds(t *testing.T) {
+	calls := 0
+	err := connectWithRetry(context.Background(), &ConnectRetry{
+		MaxWait:         time.Second,
+		InitialInterval: time.Millisecond,
+	}, func() error {
+		calls++
+		if calls < 3 {
+			return syscall.ECONNREFUSED
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3", calls)
+	}
+}
+
+func TestConnectWithRetryBackoff(t *testing.T) {
+	var callTimes []time.Time
+	_ = connectWithRetry(context.Background(), &ConnectRetry{
+		MaxWait:         200 * time.Millisecond,
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     40 * time.Millisecond,
+		Multiplier:      2,
+	}, func() error {
+		callTimes = append(callTimes, time.Now())
+		return syscall.ECONNREFUSED
+	})
+
+	// The wait doubles from the initial interval until it reaches the max interval
+	for i, want := range []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		40 * time.Millisecond,
+	} {
+		if i+1 >= len(callTimes) {
+			t.Fatalf("calls = %d, want more than %d", len(callTimes), i+1)
+		}
+		if got := callTimes[i+1].Sub(callTimes[i]); got < want {
+			t.Errorf("wait before retry %d = %s, want at least %s", i+1, got, want)
+		}
+	}
+}
+
+func TestConnectWithRetryContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := connectWithRetry(ctx, &ConnectRetry{MaxWait: time.Minute}, func() error {
+		return syscall.ECONNREFUSED
+	})
+	if err == nil || !e.ContainsError(err, ECode020B03) {
+		t.Errorf("connectWithRetry() error = %v, want %s", err, ECode020B03)
+	}
+}
+
+func TestGetConnectRetryFromENV(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"invalid", 0},
+		{"-1m", 0},
+		{"2m", 2 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("DBCONNECTMAXWAIT", tt.value)
+
+			cr := getConnectRetryFromENV()
+			if tt.want == 0 {
+				if cr != nil {
+					t.Errorf("getConnectRetryFromENV() = %+v, want nil", cr)
+				}
+				return
+			}
+			if cr == nil || cr.MaxWait != tt.want {
+				t.Errorf("getConnectRetryFromENV() = %+v, want max wait %s", cr, tt.want)
+			}
+		})
+	}
+}
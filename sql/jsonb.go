@@ -0,0 +1,219 @@
+package sql
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/Skyrin/go-lib/e"
+)
+
+const (
+	ECode020A01 = e.Code020A + "01"
+	ECode020A02 = e.Code020A + "02"
+	ECode020A03 = e.Code020A + "03"
+	ECode020A04 = e.Code020A + "04"
+	ECode020A05 = e.Code020A + "05"
+	ECode020A06 = e.Code020A + "06"
+	ECode020A07 = e.Code020A + "07"
+)
+
+// JSONB generic wrapper for a JSON/JSONB column. It implements the sql.Scanner and
+// driver.Valuer interfaces, so it can be passed directly as a bind parameter or scan
+// destination. A NULL column scans as Valid=false and a zero value of T.
+type JSONB[T any] struct {
+	V     T
+	Valid bool // Valid is true if V is not NULL
+}
+
+// NewJSONB returns a valid JSONB wrapping the passed value
+func NewJSONB[T any](v T) JSONB[T] {
+	return JSONB[T]{V: v, Valid: true}
+}
+
+// Scan implements the sql.Scanner interface
+func (j *JSONB[T]) Scan(src interface{}) (err error) {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		var zero T
+		j.V, j.Valid = zero, false
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return e.N(ECode020A01, fmt.Sprintf("unable to scan type %T into JSONB", src))
+	}
+
+	var v T
+	if err := json.Unmarshal(b, &v); err != nil {
+		return e.W(err, ECode020A02)
+	}
+	j.V, j.Valid = v, true
+
+	return nil
+}
+
+// Value implements the driver.Valuer interface. The JSON is returned as a string, so
+// the driver sends it as text rather than bytea
+func (j JSONB[T]) Value() (driver.Value, error) {
+	if !j.Valid {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(j.V)
+	if err != nil {
+		return nil, e.W(err, ECode020A03)
+	}
+
+	return string(b), nil
+}
+
+// JSONBContains returns an expression that checks if the JSONB column contains the passed
+// value (column @> value). The value is marshalled to JSON when the SQL is generated.
+func JSONBContains(column string, v interface{}) sq.Sqlizer {
+	return jsonbContains{column: column, v: v}
+}
+
+type jsonbContains struct {
+	column string
+	v      interface{}
+}
+
+// ToSql implements sq.Sqlizer
+func (j jsonbContains) ToSql() (string, []interface{}, error) {
+	b, err := json.Marshal(j.v)
+	if err != nil {
+		return "", nil, e.W(err, ECode020A04, j.column)
+	}
+
+	return j.column + " @> ?::jsonb", []interface{}{string(b)}, nil
+}
+
+// JSONBHasKey returns an expression that checks if the top level key exists in the JSONB
+// column (column ? key). The operator is escaped, so it is not treated as a placeholder.
+func JSONBHasKey(column, key string) sq.Sqlizer {
+	return sq.Expr(column+" ?? ?", key)
+}
+
+// JSONBText returns an expression for the text value at the path within the JSONB
+// column (column->'a'->>'b'). It can be used in a select or order by clause.
+func JSONBText(column string, path ...string) sq.Sqlizer {
+	return sq.Expr(jsonbTextPath(column, path), stringsToArgs(path)...)
+}
+
+// JSONBTextEq returns an expression that checks if the text value at the path within the
+// JSONB column equals the passed value (column->'a'->>'b' = value)
+func JSONBTextEq(column string, value interface{}, path ...string) sq.Sqlizer {
+	return JSONBTextOp(column, "=", value, path...)
+}
+
+// JSONBTextOp returns an expression that compares the text value at the path within the
+// JSONB column against the passed value with the specified operator (e.g. =, <>, LIKE)
+func JSONBTextOp(column, op string, value interface{}, path ...string) sq.Sqlizer {
+	return sq.Expr(fmt.Sprintf("%s %s ?", jsonbTextPath(column, path), op),
+		append(stringsToArgs(path), value)...)
+}
+
+// JSONBPathExists returns an expression that checks if the SQL/JSON path returns any item
+// for the JSONB column (jsonb_path_exists). If vars is not nil, it is marshalled to JSON
+// and passed as the path variables, e.g. JSONBPathExists(col, "$.a ? (@ > $min)", map[string]int{"min": 1})
+func JSONBPathExists(column, path string, vars interface{}) sq.Sqlizer {
+	return jsonbPathExists{column: column, path: path, vars: vars}
+}
+
+type jsonbPathExists struct {
+	column string
+	path   string
+	vars   interface{}
+}
+
+// ToSql implements sq.Sqlizer
+func (j jsonbPathExists) ToSql() (string, []interface{}, error) {
+	if j.vars == nil {
+		return fmt.Sprintf("jsonb_path_exists(%s, ?::jsonpath)", j.column),
+			[]interface{}{j.path}, nil
+	}
+
+	b, err := json.Marshal(j.vars)
+	if err != nil {
+		return "", nil, e.W(err, ECode020A05, j.column)
+	}
+
+	return fmt.Sprintf("jsonb_path_exists(%s, ?::jsonpath, ?::jsonb)", j.column),
+		[]interface{}{j.path, string(b)}, nil
+}
+
+// JSONBSet returns an expression that sets the value at the path within the JSONB column,
+// leaving the rest of the document untouched. It is meant to be used with an update
+// builder, e.g. db.Update(table).Set("col", sql.JSONBSet("col", []string{"a", "b"}, v)).
+// Missing keys along the path are created and a NULL column is treated as an empty object.
+func JSONBSet(column string, path []string, v interface{}) sq.Sqlizer {
+	return jsonbSet{column: column, path: path, v: v}
+}
+
+type jsonbSet struct {
+	column string
+	path   []string
+	v      interface{}
+}
+
+// ToSql implements sq.Sqlizer
+func (j jsonbSet) ToSql() (string, []interface{}, error) {
+	if len(j.path) == 0 {
+		return "", nil, e.N(ECode020A06, "a path must be specified")
+	}
+
+	b, err := json.Marshal(j.v)
+	if err != nil {
+		return "", nil, e.W(err, ECode020A07, j.column)
+	}
+
+	return fmt.Sprintf("jsonb_set(COALESCE(%s, '{}'::jsonb), ?::text[], ?::jsonb, true)", j.column),
+		[]interface{}{textArrayLiteral(j.path), string(b)}, nil
+}
+
+// jsonbTextPath builds the arrow chain for the path, using a placeholder for each key
+func jsonbTextPath(column string, path []string) string {
+	if len(path) == 0 {
+		return column + "::text"
+	}
+
+	sb := strings.Builder{}
+	_, _ = sb.WriteString(column)
+	for i := range path {
+		if i == len(path)-1 {
+			_, _ = sb.WriteString("->>?::text")
+			break
+		}
+		_, _ = sb.WriteString("->?::text")
+	}
+
+	return sb.String()
+}
+
+// stringsToArgs converts the string list to a bind parameter list
+func stringsToArgs(sList []string) (args []interface{}) {
+	args = make([]interface{}, len(sList))
+	for i, s := range sList {
+		args[i] = s
+	}
+
+	return args
+}
+
+// textArrayLiteral returns the postgres array literal for the list, so it can be bound
+// as text and cast to text[] regardless of the driver
+func textArrayLiteral(sList []string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	quoted := make([]string, len(sList))
+	for i, s := range sList {
+		quoted[i] = `"` + r.Replace(s) + `"`
+	}
+
+	return "{" + strings.Join(quoted, ",") + "}"
+}
@@ -1,10 +1,12 @@
 package sql
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"database/sql"
 
@@ -74,6 +76,11 @@ type ConnParam struct {
 	DBName     string `json:"dbname"`
 	SSLMode    string `json:"sslmode"`
 	SearchPath string `json:"searchpath"`
+
+	// ConnectRetry optional retry settings for establishing the initial connection. If
+	// not set, the connection is only attempted once. MaxWait can be set from the
+	// DBCONNECTMAXWAIT ENV variable (e.g. 2m)
+	ConnectRetry *ConnectRetry `json:"-"`
 }
 
 // GetConnParamFromENV initializes new connection parameters and populates from ENV variables
@@ -82,6 +89,9 @@ func GetConnParamFromENV() (cp *ConnParam) {
 
 	if os.Getenv("DBCONFIGPATH") != "" {
 		cp, _ = GetConnParamFromJSONConfig(os.Getenv("DBCONFIGPATH"))
+		if cp != nil {
+			cp.ConnectRetry = getConnectRetryFromENV()
+		}
 		return cp
 	}
 
@@ -106,10 +116,22 @@ func GetConnParamFromENV() (cp *ConnParam) {
 	if os.Getenv("DBSEARCHPATH") != "" {
 		cp.SearchPath = fmt.Sprintf("search_path=%s", os.Getenv("DBSEARCHPATH"))
 	}
+	cp.ConnectRetry = getConnectRetryFromENV()
 
 	return cp
 }
 
+// getConnectRetryFromENV returns the connect retry settings if the DBCONNECTMAXWAIT
+// ENV variable is set to a valid duration, otherwise nil
+func getConnectRetryFromENV() (cr *ConnectRetry) {
+	maxWait, err := time.ParseDuration(os.Getenv("DBCONNECTMAXWAIT"))
+	if err != nil || maxWait <= 0 {
+		return nil
+	}
+
+	return &ConnectRetry{MaxWait: maxWait}
+}
+
 // GetConnParamFromJSONConfig get connection params from a JSON config
 func GetConnParamFromJSONConfig(configPath string) (cp *ConnParam, err error) {
 	cp = &ConnParam{}
@@ -169,19 +191,30 @@ func GetConnectionStr(cp *ConnParam) (connStr string) {
 	return csb.String()
 }
 
-// NewPostgresConn initializes a new Postgres connection
+// NewPostgresConn initializes a new Postgres connection. If the connection parameters
+// define a ConnectRetry, the initial ping is retried with exponential backoff until it
+// succeeds or the max wait elapses. Auth failures are returned immediately. Use
+// GetConnectFailure to check the cause of a returned error.
 // FIXME: use a pool?
 func NewPostgresConn(cp *ConnParam) (conn *Connection, err error) {
+	return NewPostgresConnCtx(context.Background(), cp)
+}
+
+// NewPostgresConnCtx initializes a new Postgres connection, see NewPostgresConn. Retrying
+// the initial ping stops once ctx is done.
+func NewPostgresConnCtx(ctx context.Context, cp *ConnParam) (conn *Connection, err error) {
 	if cp == nil {
 		cp = GetConnParamFromENV()
 	}
 
-	//TODO: handle errors better
 	sqlConn, err := sql.Open("postgres", GetConnectionStr(cp))
 	if err != nil {
 		return nil, e.WWM(err, ECode020303, "Failed to connect to DB")
 	}
-	if err := sqlConn.Ping(); err != nil {
+	if err := connectWithRetry(ctx, cp.ConnectRetry, func() error {
+		return sqlConn.PingContext(ctx)
+	}); err != nil {
+		_ = sqlConn.Close()
 		return nil, e.WWM(err, ECode020304, "Failed to ping DB")
 	}
 
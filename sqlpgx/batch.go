@@ -0,0 +1,229 @@
+package sqlpgx
+
+import (
+	"context"
+	"fmt"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/Skyrin/go-lib/e"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	ECode090D01 = e.Code090D + "01"
+	ECode090D02 = e.Code090D + "02"
+	ECode090D03 = e.Code090D + "03"
+	ECode090D04 = e.Code090D + "04"
+	ECode090D05 = e.Code090D + "05"
+	ECode090D06 = e.Code090D + "06"
+	ECode090D07 = e.Code090D + "07"
+	ECode090D08 = e.Code090D + "08"
+	ECode090D09 = e.Code090D + "09"
+)
+
+type batchItemType int
+
+const (
+	batchItemExec batchItemType = iota
+	batchItemQuery
+	batchItemQueryRow
+)
+
+// Batch queues multiple statements, which can be different from each other, and sends
+// them to the database in a single round trip. Each statement can have a handler that
+// is called with its result. Create one with Connection.NewBatch.
+type Batch struct {
+	db       *Connection
+	batch    *pgx.Batch
+	itemList []*batchItem
+}
+
+// batchItem a queued statement and its result handler
+type batchItem struct {
+	t         batchItemType
+	query     string
+	fExec     func(tag pgconn.CommandTag) error
+	fQuery    func(rows *Rows) error
+	fQueryRow func(row *Row) error
+}
+
+// NewBatch initializes a new batch. If the connection is in a txn when the batch is sent,
+// the statements run in that txn. Otherwise they run in an implicit txn, so either all
+// statements succeed or none are applied.
+func (c *Connection) NewBatch() (b *Batch) {
+	return &Batch{
+		db:    c,
+		batch: &pgx.Batch{},
+	}
+}
+
+// Len returns the number of queued statements
+func (b *Batch) Len() int {
+	return len(b.itemList)
+}
+
+// Queue queues a statement that does not return rows. The optional handler is called with
+// the statement's command tag after the batch is sent.
+func (b *Batch) Queue(query string, args []interface{}, f func(tag pgconn.CommandTag) error) {
+	b.batch.Queue(query, args...)
+	b.itemList = append(b.itemList, &batchItem{
+		t:     batchItemExec,
+		query: query,
+		fExec: f,
+	})
+}
+
+// QueueQuery queues a statement that returns rows. The handler is called with the rows
+// after the batch is sent and must not keep a reference to them, as they are closed
+// once it returns.
+func (b *Batch) QueueQuery(query string, args []interface{}, f func(rows *Rows) error) {
+	b.batch.Queue(query, args...)
+	b.itemList = append(b.itemList, &batchItem{
+		t:      batchItemQuery,
+		query:  query,
+		fQuery: f,
+	})
+}
+
+// QueueQueryRow queues a statement that returns a single row. The handler is called with
+// the row after the batch is sent.
+func (b *Batch) QueueQueryRow(query string, args []interface{}, f func(row *Row) error) {
+	b.batch.Queue(query, args...)
+	b.itemList = append(b.itemList, &batchItem{
+		t:         batchItemQueryRow,
+		query:     query,
+		fQueryRow: f,
+	})
+}
+
+// QueueBuilder converts the insert/update/delete builder to a SQL statement and bind
+// parameters, then queues it. See Queue for details.
+func (b *Batch) QueueBuilder(sb sq.Sqlizer, f func(tag pgconn.CommandTag) error) (err error) {
+	stmt, bindList, err := sb.ToSql()
+	if err != nil {
+		// Not logging args because it may contain sensitive information. The
+		// caller can log them if needed
+		return e.W(err, ECode090D01, fmt.Sprintf("stmt: %s\n", stmt))
+	}
+
+	b.Queue(stmt, bindList, f)
+
+	return nil
+}
+
+// Send sends all queued statements in a single round trip and calls each statement's
+// handler, in the order they were queued. It stops at the first failed statement or
+// handler and returns its error. The batch is reset afterwards, so it can be reused.
+func (b *Batch) Send(ctx context.Context) (err error) {
+	defer b.reset()
+
+	if len(b.itemList) == 0 {
+		return nil
+	}
+
+	var br pgx.BatchResults
+	if b.db.txn != nil {
+		br = b.db.Txn().SendBatch(ctx, b.batch)
+	} else {
+		br = b.db.DB.SendBatch(ctx, b.batch)
+	}
+
+	for i, item := range b.itemList {
+		if err := item.read(br); err != nil {
+			_ = br.Close()
+			// Not logging args because it may contain sensitive information. The
+			// caller can log them if needed
+			return e.W(err, ECode090D02,
+				fmt.Sprintf("batch item: %d, query: %s\n", i, item.query))
+		}
+	}
+
+	if err := br.Close(); err != nil {
+		return e.W(err, ECode090D03)
+	}
+
+	return nil
+}
+
+// reset clears all queued statements
+func (b *Batch) reset() {
+	b.batch = &pgx.Batch{}
+	b.itemList = nil
+}
+
+// read reads the next result from the batch results and calls the item's handler. If a
+// query has no handler, its result is read as an exec, discarding any rows.
+func (item *batchItem) read(br pgx.BatchResults) (err error) {
+	switch {
+	case item.t == batchItemQuery && item.fQuery != nil:
+		rows, err := br.Query()
+		if err != nil {
+			return e.W(err, ECode090D04)
+		}
+		defer rows.Close()
+
+		if err := item.fQuery(&Rows{rows: &rows, query: item.query}); err != nil {
+			return e.W(err, ECode090D05)
+		}
+
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return e.W(err, ECode090D06)
+		}
+	case item.t == batchItemQueryRow && item.fQueryRow != nil:
+		rows, err := br.Query()
+		if err != nil {
+			return e.W(err, ECode090D04)
+		}
+		defer rows.Close()
+
+		var row pgx.Row = &batchRow{rows: rows}
+		if err := item.fQueryRow(&Row{row: &row, query: item.query}); err != nil {
+			return e.W(err, ECode090D07)
+		}
+
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return e.W(err, ECode090D06)
+		}
+	default:
+		tag, err := br.Exec()
+		if err != nil {
+			return e.W(err, ECode090D08)
+		}
+
+		if item.fExec != nil {
+			if err := item.fExec(tag); err != nil {
+				return e.W(err, ECode090D09)
+			}
+		}
+	}
+
+	return nil
+}
+
+// batchRow implements pgx.Row on top of the batch rows, so they can be closed after the
+// handler returns even if it did not call Scan
+type batchRow struct {
+	rows pgx.Rows
+}
+
+// Scan scans the first row and closes the rows, returning pgx.ErrNoRows if there is none
+func (r *batchRow) Scan(dest ...interface{}) (err error) {
+	defer r.rows.Close()
+
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return pgx.ErrNoRows
+	}
+
+	if err := r.rows.Scan(dest...); err != nil {
+		return err
+	}
+	r.rows.Close()
+
+	return r.rows.Err()
+}
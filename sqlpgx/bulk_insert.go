@@ -13,6 +13,10 @@ import (
 const (
 	DefaultMaxParamPerInsert  = 15000
 	AbsoluteMaxParamPerInsert = 65535
+	DefaultMaxRowPerCopy      = 10000
+
+	bulkInsertStagingTable = "bulk_insert_staging"
+	bulkInsertStagingRow   = "bulk_insert_staging_row"
 
 	ECode090701 = e.Code0907 + "01"
 	ECode090702 = e.Code0907 + "02"
@@ -25,6 +29,14 @@ const (
 	ECode090709 = e.Code0907 + "09"
 	ECode09070A = e.Code0907 + "0A"
 	ECode09070B = e.Code0907 + "0B"
+	ECode09070C = e.Code0907 + "0C"
+	ECode09070D = e.Code0907 + "0D"
+	ECode09070E = e.Code0907 + "0E"
+	ECode09070F = e.Code0907 + "0F"
+	ECode09070G = e.Code0907 + "0G"
+	ECode09070H = e.Code0907 + "0H"
+	ECode09070I = e.Code0907 + "0I"
+	ECode09070J = e.Code0907 + "0J"
 )
 
 // BulkInsert allows for multiple inserts to be ran in a single query, speeding up
@@ -40,9 +52,13 @@ type BulkInsert struct {
 	preInsert         func() error    // Called immediately before an insert is executed
 	postInsert        func(int) error // Called after an insert has been executed
 	batch             *pgx.Batch
-	mutex             sync.RWMutex // Mutex for thread safe adding to bulk insert
-	count             int          // Keeps track of current number of calls to Add, since last Flush
-	total             int          // Keeps track of total number of calls to Add
+	enableCopy        bool            // Indicate whether to send rows using COPY instead of INSERT
+	maxRowPerCopy     int             // The maximum number of rows to buffer before sending a COPY
+	conflictColumns   string          // The conflict columns to dedupe the staged rows on, if copy is enabled
+	rowList           [][]interface{} // Rows buffered for the next COPY, if enabled
+	mutex             sync.RWMutex    // Mutex for thread safe adding to bulk insert
+	count             int             // Keeps track of current number of calls to Add, since last Flush
+	total             int             // Keeps track of total number of calls to Add
 }
 
 // NewBulkInsert initializes a new BulkInsert, specifying the table, columns and optional suffix
@@ -62,6 +78,7 @@ func NewBulkInsert(ctx context.Context, db *Connection, table, columns, suffix s
 		Columns:           columns,
 		Suffix:            suffix,
 		maxParamPerInsert: DefaultMaxParamPerInsert,
+		maxRowPerCopy:     DefaultMaxRowPerCopy,
 		paramPerStatement: len(strings.Split(columns, ",")),
 		mutex:             sync.RWMutex{},
 		batch:             &pgx.Batch{},
@@ -126,6 +143,54 @@ func (bi *BulkInsert) SetPostInsert(f func(rowCount int) error) {
 	bi.postInsert = f
 }
 
+// EnableCopy switches the bulk insert to send rows using the COPY protocol (pgx.CopyFrom)
+// instead of batches of INSERT statements, which is considerably faster for large loads.
+// Rows are buffered in memory until the max rows per copy is reached or Flush is called,
+// then sent in one COPY in its own txn. The rows are not streamed, so memory use is bounded
+// by the max rows per copy, as it is by the max params per insert without copy, see
+// SetMaxRowPerCopy. If a suffix is set (e.g. ON CONFLICT DO UPDATE), the rows are copied
+// into a temporary staging table and then inserted into the table with the suffix applied,
+// as COPY does not support it. With ON CONFLICT DO UPDATE, the insert fails if a COPY has
+// several rows with the same conflict key, unless the conflict columns are set with
+// SetCopyConflictColumns.
+func (bi *BulkInsert) EnableCopy() {
+	bi.mutex.Lock()
+	defer func() {
+		bi.mutex.Unlock()
+	}()
+
+	bi.enableCopy = true
+}
+
+// SetMaxRowPerCopy sets the maximum number of rows to buffer before sending a COPY. Only
+// used if copy is enabled. The buffered rows are held in memory, so the limit bounds the
+// memory used, e.g. rows with large values need a lower limit.
+func (bi *BulkInsert) SetMaxRowPerCopy(maxRows int) {
+	bi.mutex.Lock()
+	defer func() {
+		bi.mutex.Unlock()
+	}()
+
+	if maxRows <= 0 {
+		maxRows = DefaultMaxRowPerCopy
+	}
+
+	bi.maxRowPerCopy = maxRows
+}
+
+// SetCopyConflictColumns sets the columns of the suffix's conflict target (e.g. "id" for
+// ON CONFLICT (id) DO UPDATE). The rows copied into the staging table are then deduped on
+// these columns, keeping the last row added for each, before they are inserted into the
+// table. Only used if copy is enabled and a suffix is set.
+func (bi *BulkInsert) SetCopyConflictColumns(columns string) {
+	bi.mutex.Lock()
+	defer func() {
+		bi.mutex.Unlock()
+	}()
+
+	bi.conflictColumns = columns
+}
+
 // GetCount returns the number of rows that have been added to the bulk insert
 func (bi *BulkInsert) GetCount() (count int) {
 	return bi.count
@@ -155,6 +220,10 @@ func (bi *BulkInsert) Add(ctx context.Context, values ...interface{}) (rowsInser
 	bi.count++
 	bi.total++
 
+	if bi.enableCopy {
+		return bi.addCopyRow(ctx, values)
+	}
+
 	ib := bi.db.Insert(bi.Table).Columns(bi.Columns).Values(values...)
 
 	if bi.Suffix != "" {
@@ -204,11 +273,42 @@ func (bi *BulkInsert) Close() (errList []error) {
 		bi.mutex.Unlock()
 	}()
 
-	bi.batch = &pgx.Batch{}
+	bi.reset()
 
 	return errList
 }
 
+// reset clears the queued statements and buffered rows. The caller must hold the mutex.
+func (bi *BulkInsert) reset() {
+	bi.batch = &pgx.Batch{}
+	bi.rowList = nil
+}
+
+// addCopyRow buffers the values for the next COPY. If the max rows per copy is reached,
+// then it sends the buffered rows and returns the number of rows sent.
+func (bi *BulkInsert) addCopyRow(ctx context.Context, values []interface{}) (rowsInserted int, err error) {
+	if len(values) != bi.paramPerStatement {
+		return 0, e.N(ECode09070C, "number of values must equal number of columns")
+	}
+
+	bi.rowList = append(bi.rowList, values)
+	bi.paramCount += bi.paramPerStatement
+
+	if len(bi.rowList) < bi.maxRowPerCopy {
+		return 0, nil
+	}
+
+	if err := bi.exec(ctx); err != nil {
+		return 0, e.W(err, ECode09070D)
+	}
+
+	// Get the number of rows that were inserted before the begin call resets the count
+	rowsInserted = bi.count
+	bi.begin(ctx)
+
+	return rowsInserted, nil
+}
+
 // Flush if there is a remaining statement to run, it will
 // execute the query
 func (bi *BulkInsert) Flush(ctx context.Context) (err error) {
@@ -229,12 +329,12 @@ func (bi *BulkInsert) Flush(ctx context.Context) (err error) {
 }
 
 // begin initializes an insert builder and also resets it after a statement
-// has been executed
+// has been executed. The caller must hold the mutex, except when initializing.
 func (bi *BulkInsert) begin(ctx context.Context) {
 	bi.paramCount = 0
 	bi.count = 0
 
-	bi.Close()
+	bi.reset()
 }
 
 // exec runs the insert statement
@@ -253,6 +353,30 @@ func (bi *BulkInsert) exec(ctx context.Context) (err error) {
 	}
 	defer tx.Rollback(ctx)
 
+	if bi.enableCopy {
+		if err := bi.copy(ctx, tx); err != nil {
+			return e.W(err, ECode09070E)
+		}
+	} else if err := bi.sendBatch(ctx, tx); err != nil {
+		return e.W(err, ECode09070F)
+	}
+
+	// Commit the transaction
+	if err = tx.Commit(ctx); err != nil {
+		return e.W(err, ECode090705, "error committing transaction")
+	}
+
+	// If post insert is set, call it
+	if bi.postInsert != nil {
+		if err := bi.postInsert(bi.count); err != nil {
+			return e.W(err, ECode09070B)
+		}
+	}
+	return nil
+}
+
+// sendBatch sends the batch of insert statements in the txn
+func (bi *BulkInsert) sendBatch(ctx context.Context, tx pgx.Tx) (err error) {
 	count := bi.batch.Len()
 
 	// Send the batch
@@ -263,22 +387,56 @@ func (bi *BulkInsert) exec(ctx context.Context) (err error) {
 	for i := 0; i < count; i++ {
 		_, err := results.Exec()
 		if err != nil {
-			msg := fmt.Sprintf("error executing batch command %d: %w", i, err)
-
-			return e.N(ECode090709, msg)
+			return e.W(err, ECode090709, fmt.Sprintf("error executing batch command %d", i))
 		}
 	}
 
-	// Commit the transaction
-	if err = tx.Commit(ctx); err != nil {
-		return e.W(err, ECode090705, "error committing transaction")
+	return nil
+}
+
+// copy sends the buffered rows in the txn using the COPY protocol. If a suffix is set, the
+// rows are copied into a temporary staging table, which is dropped on commit, and then
+// inserted into the table with the suffix applied, deduped on the conflict columns if set.
+func (bi *BulkInsert) copy(ctx context.Context, tx pgx.Tx) (err error) {
+	columnList := strings.Split(bi.Columns, ",")
+	for i := range columnList {
+		columnList[i] = strings.TrimSpace(columnList[i])
 	}
 
-	// If post insert is set, call it
-	if bi.postInsert != nil {
-		if err := bi.postInsert(bi.count); err != nil {
-			return e.W(err, ECode09070B)
+	table := pgx.Identifier(strings.Split(bi.Table, "."))
+	if bi.Suffix == "" {
+		if _, err := tx.CopyFrom(ctx, table, columnList, pgx.CopyFromRows(bi.rowList)); err != nil {
+			return e.W(err, ECode09070H, fmt.Sprintf("error copying into: %s", table.Sanitize()))
 		}
+		return nil
+	}
+
+	staging := pgx.Identifier{bulkInsertStagingTable}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(
+		`CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA;
+		ALTER TABLE %s ADD COLUMN %s BIGSERIAL`,
+		staging.Sanitize(), bi.Columns, table.Sanitize(),
+		staging.Sanitize(), bulkInsertStagingRow)); err != nil {
+		return e.W(err, ECode09070G, "error creating staging table")
+	}
+
+	if _, err := tx.CopyFrom(ctx, staging, columnList, pgx.CopyFromRows(bi.rowList)); err != nil {
+		return e.W(err, ECode09070J, fmt.Sprintf("error copying into: %s", staging.Sanitize()))
 	}
+
+	// Keep only the last row added for each conflict key, as ON CONFLICT DO UPDATE can not
+	// update the same row twice in one statement
+	selectStmt := fmt.Sprintf(`SELECT %s FROM %s`, bi.Columns, staging.Sanitize())
+	if bi.conflictColumns != "" {
+		selectStmt = fmt.Sprintf(`SELECT DISTINCT ON (%s) %s FROM %s ORDER BY %s, %s DESC`,
+			bi.conflictColumns, bi.Columns, staging.Sanitize(), bi.conflictColumns,
+			bulkInsertStagingRow)
+	}
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (%s) %s %s`,
+		table.Sanitize(), bi.Columns, selectStmt, bi.Suffix)); err != nil {
+		return e.W(err, ECode09070I, "error inserting from staging table")
+	}
+
 	return nil
 }
@@ -0,0 +1,78 @@
+package sqlpgx
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+const benchmarkBulkInsertTable = "bulk_insert_benchmark"
+
+// BenchmarkBulkInsert compares sending rows with batches of INSERT statements against the
+// COPY protocol. It needs a database, set with the DB* ENV variables (see
+// GetConnParamFromENV), and is skipped otherwise, e.g.
+// DBHOST=localhost DBUSER=postgres DBNAME=test go test -run - -bench BulkInsert ./sqlpgx
+func BenchmarkBulkInsert(b *testing.B) {
+	if os.Getenv("DBHOST") == "" && os.Getenv("DBCONFIGPATH") == "" {
+		b.Skip("DBHOST not set")
+	}
+
+	ctx := context.Background()
+	db, err := NewPostgresConn(ctx, GetConnParamFromENV())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.DB.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id INT PRIMARY KEY, name TEXT NOT NULL, amount NUMERIC NOT NULL)`,
+		benchmarkBulkInsertTable)); err != nil {
+		b.Fatal(err)
+	}
+	defer db.DB.Exec(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s`, benchmarkBulkInsertTable))
+
+	for _, rowCount := range []int{10000, 100000, 1000000} {
+		for _, enableCopy := range []bool{false, true} {
+			name := fmt.Sprintf("insert/%d", rowCount)
+			if enableCopy {
+				name = fmt.Sprintf("copy/%d", rowCount)
+			}
+
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					benchmarkBulkInsert(ctx, b, db, rowCount, enableCopy)
+				}
+				b.ReportMetric(float64(rowCount*b.N)/b.Elapsed().Seconds(), "rows/s")
+			})
+		}
+	}
+}
+
+// benchmarkBulkInsert inserts the number of rows into the emptied benchmark table
+func benchmarkBulkInsert(ctx context.Context, b *testing.B, db *Connection, rowCount int,
+	enableCopy bool) {
+	b.StopTimer()
+	if _, err := db.DB.Exec(ctx, fmt.Sprintf(`TRUNCATE %s`, benchmarkBulkInsertTable)); err != nil {
+		b.Fatal(err)
+	}
+
+	bi, err := NewBulkInsert(ctx, db, benchmarkBulkInsertTable, "id, name, amount", "", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if enableCopy {
+		bi.EnableCopy()
+	}
+	b.StartTimer()
+
+	for i := 0; i < rowCount; i++ {
+		if _, err := bi.Add(ctx, i, fmt.Sprintf("name %d", i), i*100); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if err := bi.Flush(ctx); err != nil {
+		b.Fatal(err)
+	}
+}
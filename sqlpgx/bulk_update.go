@@ -224,9 +224,7 @@ func (bu *BulkUpdate) exec(ctx context.Context) (err error) {
 	for i := 0; i < count; i++ {
 		_, err := results.Exec()
 		if err != nil {
-			msg := fmt.Sprintf("error executing batch command %d: %w", i, err)
-
-			return e.N(ECode090908, msg)
+			return e.W(err, ECode090908, fmt.Sprintf("error executing batch command %d", i))
 		}
 	}
 
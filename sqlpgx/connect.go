@@ -0,0 +1,152 @@
+package sqlpgx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Defaults used when a ConnectRetry field is not set
+	DefaultConnectRetryInitialInterval = 500 * time.Millisecond
+	DefaultConnectRetryMaxInterval     = 30 * time.Second
+	DefaultConnectRetryMultiplier      = 2
+
+	ConnectFailureNone        = ConnectFailure("")
+	ConnectFailureAuth        = ConnectFailure("auth")        // Credentials rejected, never retried
+	ConnectFailureDNS         = ConnectFailure("dns")         // Host could not be resolved
+	ConnectFailureUnreachable = ConnectFailure("unreachable") // Refused, timed out or server not accepting connections yet
+	ConnectFailureUnknown     = ConnectFailure("unknown")
+
+	ECode090B01 = e.Code090B + "01"
+	ECode090B02 = e.Code090B + "02"
+	ECode090B03 = e.Code090B + "03"
+)
+
+// ConnectFailure the cause of a failed connection attempt
+type ConnectFailure string
+
+// ConnectRetry defines how the initial connection is retried with exponential backoff.
+// Retries stop once MaxWait has elapsed or an auth failure is returned.
+type ConnectRetry struct {
+	MaxWait         time.Duration // Maximum total time to keep retrying, 0 disables retries
+	InitialInterval time.Duration // Wait before the first retry
+	MaxInterval     time.Duration // Upper bound of the wait between retries
+	Multiplier      float64       // Growth factor applied to the wait after each retry
+}
+
+// GetConnectFailure classifies the cause of a connection error
+func GetConnectFailure(err error) ConnectFailure {
+	if err == nil {
+		return ConnectFailureNone
+	}
+
+	var pgErr *pgconn.PgError
+	if asConnectError(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, "28"): // invalid_authorization_specification/invalid_password
+			return ConnectFailureAuth
+		case pgErr.Code == "57P03": // cannot_connect_now, e.g. the database system is starting up
+			return ConnectFailureUnreachable
+		}
+		return ConnectFailureUnknown
+	}
+
+	var dnsErr *net.DNSError
+	if asConnectError(err, &dnsErr) {
+		return ConnectFailureDNS
+	}
+
+	var opErr *net.OpError
+	if asConnectError(err, &opErr) ||
+		isConnectError(err, syscall.ECONNREFUSED) ||
+		isConnectError(err, os.ErrDeadlineExceeded) ||
+		isConnectError(err, context.DeadlineExceeded) ||
+		isConnectError(err, io.EOF) {
+		return ConnectFailureUnreachable
+	}
+
+	return ConnectFailureUnknown
+}
+
+// asConnectError calls errors.As, checking the original error if it is an extended error
+func asConnectError(err error, tgt interface{}) bool {
+	if ee := e.AsExtendedError(err); ee != nil {
+		return ee.AsError(tgt)
+	}
+
+	return errors.As(err, tgt)
+}
+
+// isConnectError calls errors.Is, checking the original error if it is an extended error
+func isConnectError(err, tgt error) bool {
+	if ee := e.AsExtendedError(err); ee != nil {
+		return ee.IsError(tgt)
+	}
+
+	return errors.Is(err, tgt)
+}
+
+// connectWithRetry calls f until it succeeds, the retry max wait elapses, the context is
+// done or an auth failure is returned. The wait between attempts grows exponentially.
+func connectWithRetry(ctx context.Context, r *ConnectRetry, f func() error) (err error) {
+	if r == nil || r.MaxWait <= 0 {
+		return f()
+	}
+
+	interval, maxInterval, multiplier := r.InitialInterval, r.MaxInterval, r.Multiplier
+	if interval <= 0 {
+		interval = DefaultConnectRetryInitialInterval
+	}
+	if maxInterval <= 0 {
+		maxInterval = DefaultConnectRetryMaxInterval
+	}
+	if multiplier < 1 {
+		multiplier = DefaultConnectRetryMultiplier
+	}
+
+	deadline := time.Now().Add(r.MaxWait)
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil {
+			return nil
+		}
+
+		cause := GetConnectFailure(err)
+		if cause == ConnectFailureAuth {
+			return e.W(err, ECode090B01, string(cause))
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return e.W(err, ECode090B02, string(cause),
+				"gave up after", r.MaxWait.String())
+		}
+		if interval > remaining {
+			interval = remaining
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Str("cause", string(cause)).
+			Msgf("[connectWithRetry] unable to connect to DB, retrying in %s", interval)
+
+		select {
+		case <-ctx.Done():
+			return e.W(err, ECode090B03, string(cause), ctx.Err().Error())
+		case <-time.After(interval):
+		}
+
+		interval = time.Duration(float64(interval) * multiplier)
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
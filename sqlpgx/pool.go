@@ -0,0 +1,193 @@
+package sqlpgx
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// DefaultPoolName the name of the pool returned by NewPostgresConn
+	DefaultPoolName = "default"
+
+	ECode090C01 = e.Code090C + "01"
+	ECode090C02 = e.Code090C + "02"
+	ECode090C03 = e.Code090C + "03"
+	ECode090C04 = e.Code090C + "04"
+)
+
+// pool a registered connection pool and the parameters it was created with
+type pool struct {
+	conn *Connection
+	cp   ConnParam
+}
+
+var (
+	poolMutex sync.Mutex
+	poolMap   = map[string]*pool{}
+)
+
+// NewNamedPostgresConn returns the connection pool registered with the specified name,
+// creating and registering it if it does not exist yet. Calling it again with the same
+// name and connection parameters returns the same pool. If the name is already registered
+// with different connection parameters, an error is returned. This allows an application
+// to use multiple databases, e.g. a primary and an analytics database, each with its own
+// pool.
+//
+// The pool is created without holding the registry lock, so retrying the connection to one
+// database does not block the lookups of other pools. If the same name is registered while
+// the pool is created, the new pool is closed and the registered one is used instead.
+func NewNamedPostgresConn(ctx context.Context, name string, cp *ConnParam) (conn *Connection, err error) {
+	if name == "" {
+		return nil, e.N(ECode090C01, "a pool name must be specified")
+	}
+
+	if cp == nil {
+		cp = GetConnParamFromENV()
+	}
+
+	conn, ok, err := getRegisteredPool(name, cp)
+	if err != nil || ok {
+		return conn, err
+	}
+
+	db, err := newPool(ctx, name, cp)
+	if err != nil {
+		return nil, e.W(err, ECode090C03, name)
+	}
+
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	if _, ok := poolMap[name]; ok {
+		// Registered while this pool was created
+		db.Close()
+		conn, _, err = getRegisteredPoolLocked(name, cp)
+		return conn, err
+	}
+
+	conn = &Connection{
+		DB:       db,
+		poolName: name,
+		Slug:     NewSlug(nil),
+	}
+	poolMap[name] = &pool{
+		conn: conn,
+		cp:   *cp,
+	}
+
+	return conn, nil
+}
+
+// getRegisteredPool returns the connection pool registered with the name, if any. It
+// returns an error if it was registered with different connection parameters.
+func getRegisteredPool(name string, cp *ConnParam) (conn *Connection, ok bool, err error) {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	return getRegisteredPoolLocked(name, cp)
+}
+
+// getRegisteredPoolLocked see getRegisteredPool, the caller must hold poolMutex
+func getRegisteredPoolLocked(name string, cp *ConnParam) (conn *Connection, ok bool, err error) {
+	p, ok := poolMap[name]
+	if !ok {
+		return nil, false, nil
+	}
+
+	if !p.cp.isSamePool(cp) {
+		return nil, true, e.N(ECode090C02,
+			fmt.Sprintf("pool '%s' already registered with different connection parameters", name))
+	}
+
+	return p.conn, true, nil
+}
+
+// GetPool returns the connection pool registered with the specified name
+func GetPool(name string) (conn *Connection, err error) {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	p, ok := poolMap[name]
+	if !ok {
+		return nil, e.N(ECode090C04, fmt.Sprintf("pool '%s' is not registered", name))
+	}
+
+	return p.conn, nil
+}
+
+// GetPoolNameList returns the names of all registered pools, sorted by name
+func GetPoolNameList() (nameList []string) {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	nameList = make([]string, 0, len(poolMap))
+	for name := range poolMap {
+		nameList = append(nameList, name)
+	}
+	sort.Strings(nameList)
+
+	return nameList
+}
+
+// ClosePool closes the connection pool registered with the specified name and removes it
+// from the registry. It does nothing if the name is not registered.
+func ClosePool(name string) {
+	poolMutex.Lock()
+	p, ok := poolMap[name]
+	delete(poolMap, name)
+	poolMutex.Unlock()
+
+	if ok {
+		p.conn.DB.Close()
+	}
+}
+
+// CloseAllPools closes all registered connection pools and clears the registry
+func CloseAllPools() {
+	for _, name := range GetPoolNameList() {
+		ClosePool(name)
+	}
+}
+
+// unregisterPool removes the pool from the registry if it is still registered under the
+// name. Called when a connection is closed directly.
+func unregisterPool(name string, db *pgxpool.Pool) {
+	if name == "" {
+		return
+	}
+
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	if p, ok := poolMap[name]; ok && p.conn.DB == db {
+		delete(poolMap, name)
+	}
+}
+
+// isSamePool checks if the connection parameters would result in the same pool. The
+// connect retry settings are ignored, as they only apply while creating the pool. The
+// trace settings are compared, as the tracer is attached to the pool's config.
+func (cp ConnParam) isSamePool(other *ConnParam) bool {
+	return GetConnectionStr(&cp) == GetConnectionStr(other) &&
+		cp.MaxConns == other.MaxConns &&
+		cp.MinConns == other.MinConns &&
+		cp.HealthCheckPeriod == other.HealthCheckPeriod &&
+		cp.MaxConnLifetime == other.MaxConnLifetime &&
+		strings.Join(cp.Types, ",") == strings.Join(other.Types, ",") &&
+		isSameTrace(cp.Trace, other.Trace)
+}
+
+// isSameTrace checks if the trace settings are the same, either both unset or equal
+func isSameTrace(tp, other *TraceParam) bool {
+	if tp == nil || other == nil {
+		return tp == other
+	}
+
+	return *tp == *other
+}
@@ -5,8 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/Skyrin/go-lib/e"
@@ -53,11 +54,14 @@ const (
 	ECode09030X = e.Code0903 + "0X"
 	ECode09030Y = e.Code0903 + "0Y"
 	ECode09030Z = e.Code0903 + "0Z"
+	ECode090310 = e.Code0903 + "10"
+	ECode090311 = e.Code0903 + "11"
 )
 
 // Connection wrapper of the *pgxpool.Pool
 type Connection struct {
 	DB           *pgxpool.Pool
+	poolName     string // The name the pool is registered as
 	Slug         *Slug
 	txn          *Txn
 	txnIdx       int
@@ -74,12 +78,28 @@ type ConnParam struct {
 	DBName     string `json:"dbname"`
 	SSLMode    string `json:"sslmode"`
 	SearchPath string `json:"searchpath"`
-}
 
-var (
-	dbConn *Connection
-	once   sync.Once
-)
+	// Pool settings, zero values use the pgxpool defaults. The durations can be set from
+	// the DBHEALTHCHECKPERIOD and DBMAXCONNLIFETIME ENV variables (e.g. 1m, 1h)
+	MaxConns          int32         `json:"maxconns"`
+	MinConns          int32         `json:"minconns"`
+	HealthCheckPeriod time.Duration `json:"-"`
+	MaxConnLifetime   time.Duration `json:"-"`
+
+	// ConnectRetry optional retry settings for establishing the initial connection. If
+	// not set, the connection is only attempted once. MaxWait can be set from the
+	// DBCONNECTMAXWAIT ENV variable (e.g. 2m)
+	ConnectRetry *ConnectRetry `json:"-"`
+
+	// Types optional list of custom types (enums, composites), optionally schema qualified,
+	// to register on each connection, along with their array types. A type must be listed
+	// after any custom types it depends on. See Enum for mapping enums to Go constants
+	Types []string `json:"types"`
+
+	// Trace optional query tracer settings. If set, queries, batches and copies run on
+	// the pool are logged, see TraceParam
+	Trace *TraceParam `json:"-"`
+}
 
 // GetConnParamFromENV initializes new connection parameters and populates from ENV variables
 func GetConnParamFromENV() (cp *ConnParam) {
@@ -87,6 +107,9 @@ func GetConnParamFromENV() (cp *ConnParam) {
 
 	if os.Getenv("DBCONFIGPATH") != "" {
 		cp, _ = GetConnParamFromJSONConfig(os.Getenv("DBCONFIGPATH"))
+		if cp != nil {
+			setConnParamDurationsFromENV(cp)
+		}
 		return cp
 	}
 
@@ -111,10 +134,35 @@ func GetConnParamFromENV() (cp *ConnParam) {
 	if os.Getenv("DBSEARCHPATH") != "" {
 		cp.SearchPath = fmt.Sprintf("search_path=%s", os.Getenv("DBSEARCHPATH"))
 	}
+	if os.Getenv("DBMAXCONNS") != "" {
+		if i, err := strconv.ParseInt(os.Getenv("DBMAXCONNS"), 10, 32); err == nil {
+			cp.MaxConns = int32(i)
+		}
+	}
+	if os.Getenv("DBMINCONNS") != "" {
+		if i, err := strconv.ParseInt(os.Getenv("DBMINCONNS"), 10, 32); err == nil {
+			cp.MinConns = int32(i)
+		}
+	}
+	setConnParamDurationsFromENV(cp)
 
 	return cp
 }
 
+// setConnParamDurationsFromENV sets the duration based connection parameters from their
+// ENV variables, ignoring any that are not set to a valid duration
+func setConnParamDurationsFromENV(cp *ConnParam) {
+	if d, err := time.ParseDuration(os.Getenv("DBHEALTHCHECKPERIOD")); err == nil && d > 0 {
+		cp.HealthCheckPeriod = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("DBMAXCONNLIFETIME")); err == nil && d > 0 {
+		cp.MaxConnLifetime = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("DBCONNECTMAXWAIT")); err == nil && d > 0 {
+		cp.ConnectRetry = &ConnectRetry{MaxWait: d}
+	}
+}
+
 // GetConnParamFromJSONConfig get connection params from a JSON config
 func GetConnParamFromJSONConfig(configPath string) (cp *ConnParam, err error) {
 	cp = &ConnParam{}
@@ -174,17 +222,47 @@ func GetConnectionStr(cp *ConnParam) (connStr string) {
 	return csb.String()
 }
 
-// NewPostgresConn initializes a new Postgres connection
+// NewPostgresConn returns the default connection pool, creating it if it has not been
+// created yet. See NewNamedPostgresConn for details.
 func NewPostgresConn(ctx context.Context, cp *ConnParam) (conn *Connection, err error) {
-	if cp == nil {
-		cp = GetConnParamFromENV()
+	conn, err = NewNamedPostgresConn(ctx, DefaultPoolName, cp)
+	if err != nil {
+		return nil, e.W(err, ECode090303)
 	}
 
-	var intError error
+	return conn, nil
+}
 
+// newPool initializes a new connection pool with the specified name. If the connection parameters define a
+// ConnectRetry, the initial ping is retried with exponential backoff until it succeeds,
+// the max wait elapses or the context is done. Auth failures are returned immediately.
+// Use GetConnectFailure to check the cause of a returned error.
+func newPool(ctx context.Context, name string, cp *ConnParam) (db *pgxpool.Pool, err error) {
 	config, err := pgxpool.ParseConfig(GetConnectionStr(cp))
 	if err != nil {
-		return nil, err
+		return nil, e.W(err, ECode090310)
+	}
+
+	if cp.MaxConns > 0 {
+		config.MaxConns = cp.MaxConns
+	}
+	if cp.MinConns > 0 {
+		config.MinConns = cp.MinConns
+	}
+	if cp.HealthCheckPeriod > 0 {
+		config.HealthCheckPeriod = cp.HealthCheckPeriod
+	}
+	if cp.MaxConnLifetime > 0 {
+		config.MaxConnLifetime = cp.MaxConnLifetime
+	}
+
+	if cp.Trace != nil {
+		config.ConnConfig.Tracer = NewTracer(name, cp.Trace)
+	}
+
+	var tl *typeLoader
+	if len(cp.Types) > 0 {
+		tl = newTypeLoader(cp.Types)
 	}
 
 	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
@@ -192,31 +270,29 @@ func NewPostgresConn(ctx context.Context, cp *ConnParam) (conn *Connection, err
 		if err != nil {
 			return fmt.Errorf("failed to set time zone: %w", err)
 		}
-		return nil
-	}
-
-	once.Do(func() {
-		db, err := pgxpool.NewWithConfig(ctx, config)
-		if err != nil {
-			intError = e.WWM(err, ECode090303, "unable to create connection pool")
-			return
-		}
 
-		if err := db.Ping(ctx); err != nil {
-			intError = e.WWM(err, ECode090304, "failed to ping DB")
-			return
+		if tl != nil {
+			if err := tl.register(ctx, conn); err != nil {
+				return fmt.Errorf("failed to register types: %w", err)
+			}
 		}
 
-		dbConn = &Connection{DB: db}
-	})
+		return nil
+	}
 
-	if intError != nil {
-		return nil, intError
+	db, err = pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, e.WWM(err, ECode090311, "unable to create connection pool")
 	}
 
-	dbConn.Slug = NewSlug(nil)
+	if err := connectWithRetry(ctx, cp.ConnectRetry, func() error {
+		return db.Ping(ctx)
+	}); err != nil {
+		db.Close()
+		return nil, e.WWM(err, ECode090304, "failed to ping DB")
+	}
 
-	return dbConn, nil
+	return db, nil
 }
 
 // Ping wrapper for ping
@@ -224,8 +300,9 @@ func (c *Connection) Ping(ctx context.Context) error {
 	return c.DB.Ping(ctx)
 }
 
-// Close wrapper for close
+// Close closes the connection pool and removes it from the pool registry
 func (c *Connection) Close() {
+	unregisterPool(c.poolName, c.DB)
 	c.DB.Close()
 }
 
@@ -269,8 +346,9 @@ func (c *Connection) BeginReturnDB(ctx context.Context) (db *Connection, err err
 	c.txnIdx = c.txnIdx + 1
 
 	return &Connection{
-		DB:   c.DB,
-		Slug: c.Slug,
+		DB:       c.DB,
+		poolName: c.poolName,
+		Slug:     c.Slug,
 		txn: &Txn{
 			txn: txn,
 		},
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/Skyrin/go-lib/e"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 )
 
@@ -24,6 +25,16 @@ func IsPQError(err error, errorCode string) bool {
 	return errors.As(err, &pgErr) && string(pgErr.Code) == errorCode
 }
 
+// IsNoRowsError checks if the passed error is pgx.ErrNoRows, e.g. returned by Row.Scan
+// when the query returned no rows
+func IsNoRowsError(err error) bool {
+	if ee := e.AsExtendedError(err); ee != nil {
+		return ee.IsError(pgx.ErrNoRows)
+	}
+
+	return errors.Is(err, pgx.ErrNoRows)
+}
+
 // CheckPQError checks if it's a known postgres error and returns a proper message
 func CheckPQError(err error) error {
 	if err != nil {
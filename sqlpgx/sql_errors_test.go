@@ -0,0 +1,34 @@
+package sqlpgx
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/jackc/pgx/v5"
+)
+
+func TestIsNoRowsError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no rows", pgx.ErrNoRows, true},
+		{"wrapped", fmt.Errorf("query: %w", pgx.ErrNoRows), true},
+		{"extended", e.W(pgx.ErrNoRows, ECode090201), true},
+		{"extended twice", e.W(e.W(pgx.ErrNoRows, ECode090201), ECode090202), true},
+		{"other", errors.New("no rows in result set"), false},
+		{"extended other", e.N(ECode090201, "no rows in result set"), false},
+		{"nil", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsNoRowsError(tt.err); got != tt.want {
+				t.Errorf("IsNoRowsError(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
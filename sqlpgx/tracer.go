@@ -0,0 +1,365 @@
+package sqlpgx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	TraceArgsNone     = TraceArgs("")         // Bind arguments are not logged
+	TraceArgsRedacted = TraceArgs("redacted") // Only the bind argument types are logged
+	TraceArgsFull     = TraceArgs("full")     // Bind arguments are logged as is, may contain sensitive data
+
+	// DefaultTraceMaxSQLLength the default max length of the logged SQL
+	DefaultTraceMaxSQLLength = 1000
+)
+
+// TraceArgs defines how bind arguments are logged by the tracer
+type TraceArgs string
+
+// TraceParam configures the query tracer of a pool. Failed and slow queries are always
+// logged, other queries are logged based on the sample rate.
+type TraceParam struct {
+	SampleRate    float64       // Fraction (0-1) of successful queries to log
+	SlowThreshold time.Duration // Queries taking at least this long are logged as slow, 0 disables
+	Args          TraceArgs     // How bind arguments are logged, defaults to not logging them
+	MaxSQLLength  int           // Max length of the logged SQL, defaults to DefaultTraceMaxSQLLength
+}
+
+// Tracer implements the pgx QueryTracer, BatchTracer and CopyFromTracer interfaces,
+// writing a structured zerolog event per query with its duration, SQL fingerprint,
+// affected rows and Postgres error code
+type Tracer struct {
+	pool string
+	tp   TraceParam
+}
+
+// traceCtxKey key for storing the trace start in the context
+type traceCtxKey struct{}
+
+// traceStart tracks a traced operation from start to end
+type traceStart struct {
+	start  time.Time
+	sample bool
+	sql    string
+	args   []interface{}
+	count  int  // Number of batch queries
+	failed bool // Whether a batch query failed, so its error was already logged
+}
+
+// NewTracer initializes a new tracer for the named pool
+func NewTracer(pool string, tp *TraceParam) (t *Tracer) {
+	t = &Tracer{pool: pool}
+	if tp != nil {
+		t.tp = *tp
+	}
+
+	if t.tp.MaxSQLLength <= 0 {
+		t.tp.MaxSQLLength = DefaultTraceMaxSQLLength
+	}
+
+	return t
+}
+
+// TraceQueryStart implements pgx.QueryTracer
+func (t *Tracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn,
+	data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, traceCtxKey{}, &traceStart{
+		start:  time.Now(),
+		sample: t.sample(),
+		sql:    data.SQL,
+		args:   data.Args,
+	})
+}
+
+// TraceQueryEnd implements pgx.QueryTracer
+func (t *Tracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	ts, ok := ctx.Value(traceCtxKey{}).(*traceStart)
+	if !ok {
+		return
+	}
+
+	if ze := t.event(ts, data.Err); ze != nil {
+		t.withSQL(ze, ts.sql, ts.args).
+			Int64("rows", data.CommandTag.RowsAffected()).
+			Msg("[Tracer.query]")
+	}
+}
+
+// TraceBatchStart implements pgx.BatchTracer
+func (t *Tracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn,
+	data pgx.TraceBatchStartData) context.Context {
+	ts := &traceStart{
+		start:  time.Now(),
+		sample: t.sample(),
+	}
+	if data.Batch != nil {
+		ts.count = data.Batch.Len()
+	}
+
+	return context.WithValue(ctx, traceCtxKey{}, ts)
+}
+
+// TraceBatchQuery implements pgx.BatchTracer. Individual batch queries are only logged if
+// they fail, as their duration is not known, the batch end event covers the rest.
+func (t *Tracer) TraceBatchQuery(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchQueryData) {
+	if data.Err == nil {
+		return
+	}
+
+	if ts, ok := ctx.Value(traceCtxKey{}).(*traceStart); ok {
+		ts.failed = true
+	}
+
+	t.withSQL(log.Error().Err(data.Err), data.SQL, data.Args).
+		Str("pool", t.pool).
+		Str("errCode", getPgErrorCode(data.Err)).
+		Int64("rows", data.CommandTag.RowsAffected()).
+		Msg("[Tracer.batchQuery]")
+}
+
+// TraceBatchEnd implements pgx.BatchTracer. If a batch query failed, its error was already
+// logged with its SQL, so the batch end event is only logged if slow or sampled.
+func (t *Tracer) TraceBatchEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchEndData) {
+	ts, ok := ctx.Value(traceCtxKey{}).(*traceStart)
+	if !ok {
+		return
+	}
+
+	err := data.Err
+	if ts.failed {
+		err = nil
+	}
+
+	if ze := t.event(ts, err); ze != nil {
+		ze.Int("queries", ts.count).Msg("[Tracer.batch]")
+	}
+}
+
+// TraceCopyFromStart implements pgx.CopyFromTracer
+func (t *Tracer) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn,
+	data pgx.TraceCopyFromStartData) context.Context {
+	return context.WithValue(ctx, traceCtxKey{}, &traceStart{
+		start:  time.Now(),
+		sample: t.sample(),
+		sql: fmt.Sprintf("COPY %s (%s) FROM STDIN",
+			data.TableName.Sanitize(), strings.Join(data.ColumnNames, ", ")),
+	})
+}
+
+// TraceCopyFromEnd implements pgx.CopyFromTracer
+func (t *Tracer) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	ts, ok := ctx.Value(traceCtxKey{}).(*traceStart)
+	if !ok {
+		return
+	}
+
+	if ze := t.event(ts, data.Err); ze != nil {
+		t.withSQL(ze, ts.sql, nil).
+			Int64("rows", data.CommandTag.RowsAffected()).
+			Msg("[Tracer.copyFrom]")
+	}
+}
+
+// sample returns whether a successful, fast query should be logged
+func (t *Tracer) sample() bool {
+	if t.tp.SampleRate <= 0 {
+		return false
+	}
+
+	return t.tp.SampleRate >= 1 || rand.Float64() < t.tp.SampleRate
+}
+
+// event returns the log event for the traced operation, or nil if it should not be logged.
+// Failed operations are logged as errors, slow ones as warnings and sampled ones as info.
+func (t *Tracer) event(ts *traceStart, err error) (ze *zerolog.Event) {
+	duration := time.Since(ts.start)
+	slow := t.tp.SlowThreshold > 0 && duration >= t.tp.SlowThreshold
+
+	switch {
+	case err != nil:
+		ze = log.Error().Err(err).Str("errCode", getPgErrorCode(err))
+	case slow:
+		ze = log.Warn()
+	case ts.sample:
+		ze = log.Info()
+	default:
+		return nil
+	}
+
+	return ze.Str("pool", t.pool).
+		Dur("duration", duration).
+		Bool("slow", slow)
+}
+
+// withSQL adds the SQL, its fingerprint and the bind arguments (based on the trace
+// arguments setting) to the event
+func (t *Tracer) withSQL(ze *zerolog.Event, sql string, args []interface{}) *zerolog.Event {
+	fp := Fingerprint(sql)
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(fp))
+
+	if len(fp) > t.tp.MaxSQLLength {
+		// Cut on a rune boundary, so a multi-byte character is not split
+		n := t.tp.MaxSQLLength
+		for n > 0 && !utf8.RuneStart(fp[n]) {
+			n--
+		}
+		fp = fp[:n]
+	}
+	ze = ze.Str("sql", fp).Str("fingerprint", fmt.Sprintf("%016x", h.Sum64()))
+
+	switch t.tp.Args {
+	case TraceArgsFull:
+		ze = ze.Interface("args", args)
+	case TraceArgsRedacted:
+		typeList := make([]string, len(args))
+		for i, arg := range args {
+			typeList[i] = fmt.Sprintf("%T", arg)
+		}
+		ze = ze.Strs("args", typeList)
+	}
+
+	return ze
+}
+
+// getPgErrorCode returns the Postgres error code if the error is a Postgres error
+func getPgErrorCode(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+
+	return ""
+}
+
+// Fingerprint normalizes the SQL, so queries that only differ by literal values, comments or
+// whitespace are the same. String (including E'...' escape and $$...$$ dollar-quoted strings) and
+// numeric literals are replaced with ?, comments are removed and all whitespace is collapsed
+// to a single space. Bind parameters ($1) are left as is.
+func Fingerprint(sql string) string {
+	sb := strings.Builder{}
+	r := []rune(sql)
+	space := false
+
+	for i := 0; i < len(r); i++ {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			space = true
+			continue
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			// Skip the line comment, it ends the same as whitespace
+			for i+1 < len(r) && r[i+1] != '\n' {
+				i++
+			}
+			space = true
+			continue
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			// Skip the block comment, which may be nested
+			depth := 0
+			for ; i < len(r); i++ {
+				if r[i] == '/' && i+1 < len(r) && r[i+1] == '*' {
+					depth++
+					i++
+				} else if r[i] == '*' && i+1 < len(r) && r[i+1] == '/' {
+					depth--
+					i++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			space = true
+			continue
+		case c == '\'':
+			i = skipStringLiteral(r, i, false)
+			c = '?'
+		case (c == 'E' || c == 'e') && i+1 < len(r) && r[i+1] == '\'' &&
+			(i == 0 || !isIdentRune(r[i-1])):
+			i = skipStringLiteral(r, i+1, true)
+			c = '?'
+		case c == '$' && (i == 0 || !isIdentRune(r[i-1])):
+			if end := skipDollarQuoted(r, i); end > i {
+				i = end
+				c = '?'
+			}
+		case unicode.IsDigit(c) && (i == 0 || !isIdentRune(r[i-1])):
+			// Skip the rest of the numeric literal
+			for i+1 < len(r) && (unicode.IsDigit(r[i+1]) || r[i+1] == '.') {
+				i++
+			}
+			c = '?'
+		}
+
+		if space && sb.Len() > 0 {
+			_ = sb.WriteByte(' ')
+		}
+		space = false
+		_, _ = sb.WriteRune(c)
+	}
+
+	return sb.String()
+}
+
+// skipStringLiteral returns the index of the closing quote of the string literal starting
+// at the opening quote at index i. A doubled quote is an escaped quote and, for an escape
+// string (E'...'), so is a backslash followed by a quote
+func skipStringLiteral(r []rune, i int, escape bool) int {
+	for i++; i < len(r); i++ {
+		switch {
+		case escape && r[i] == '\\':
+			i++
+		case r[i] == '\'':
+			if i+1 < len(r) && r[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+
+	return len(r)
+}
+
+// skipDollarQuoted returns the index of the last rune of the closing tag of the
+// dollar-quoted string ($$...$$ or $tag$...$tag$) starting at index i, or i if it is
+// not a dollar-quoted string, e.g. a bind parameter ($1)
+func skipDollarQuoted(r []rune, i int) int {
+	j := i + 1
+	for j < len(r) && r[j] != '$' {
+		// The tag follows the identifier rules, without a leading digit
+		if !(r[j] == '_' || unicode.IsLetter(r[j]) || (j > i+1 && unicode.IsDigit(r[j]))) {
+			return i
+		}
+		j++
+	}
+	if j >= len(r) {
+		return i
+	}
+
+	tag := string(r[i : j+1])
+	if end := strings.Index(string(r[j+1:]), tag); end >= 0 {
+		return j + utf8.RuneCountInString(string(r[j+1:])[:end]) + len([]rune(tag))
+	}
+
+	return len(r)
+}
+
+// isIdentRune whether the rune can be part of an identifier or bind parameter, so digits
+// following it are not treated as a numeric literal
+func isIdentRune(c rune) bool {
+	return c == '_' || c == '$' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
@@ -0,0 +1,95 @@
+package sqlpgx
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+)
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{"whitespace", "SELECT  a\n\tFROM t ", "SELECT a FROM t"},
+		{"string", "SELECT a FROM t WHERE b='x'", "SELECT a FROM t WHERE b=?"},
+		{"escaped quote", "SELECT 'it''s', 'y'", "SELECT ?, ?"},
+		{"number", "SELECT a FROM t WHERE b=12.5 LIMIT 10", "SELECT a FROM t WHERE b=? LIMIT ?"},
+		{"identifier digits", "SELECT a1 FROM t2", "SELECT a1 FROM t2"},
+		{"bind parameter", "SELECT a FROM t WHERE b=$1 AND c=$12", "SELECT a FROM t WHERE b=$1 AND c=$12"},
+		{"line comment", "SELECT a -- the a\nFROM t", "SELECT a FROM t"},
+		{"line comment end", "SELECT a FROM t -- done", "SELECT a FROM t"},
+		{"block comment", "SELECT /* columns */ a FROM t", "SELECT a FROM t"},
+		{"nested block comment", "SELECT /* a /* b */ c */ a FROM t", "SELECT a FROM t"},
+		{"comment in string", "SELECT '-- x', '/* y */'", "SELECT ?, ?"},
+		{"dollar quoted", "SELECT $$it's$$, b", "SELECT ?, b"},
+		{"tagged dollar quoted", "SELECT $fn$ $$ x $fn$ FROM t", "SELECT ? FROM t"},
+		{"dollar quoted with parameter", "SELECT $$a$$, $1", "SELECT ?, $1"},
+		{"unterminated dollar quoted", "SELECT $a$ x", "SELECT ?"},
+		{"escape string", `SELECT E'it\'s' FROM t`, "SELECT ? FROM t"},
+		{"escape string backslash", `SELECT e'a\\', 'b'`, "SELECT ?, ?"},
+		{"identifier ending in e", "SELECT name'x'", "SELECT name?"},
+		{"multi-byte", "SELECT 'é' FROM tàble", "SELECT ? FROM tàble"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Fingerprint(tt.sql); got != tt.want {
+				t.Errorf("Fingerprint(%q) = %q, want %q", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFingerprintSameQuery(t *testing.T) {
+	a := Fingerprint("SELECT a FROM t WHERE b='x' -- first\nAND c=1")
+	b := Fingerprint("SELECT a\nFROM t /* second */ WHERE b='y' AND c=2")
+	if a != b {
+		t.Errorf("Fingerprint() = %q and %q, want the same", a, b)
+	}
+}
+
+func TestTracerWithSQL(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxSQLLength int
+		sql          string
+		want         string
+	}{
+		{"not truncated", 100, "SELECT tàble", "SELECT tàble"},
+		{"truncated", 6, "SELECT a FROM t", "SELECT"},
+		{"multi-byte boundary", 9, "SELECT tàble", "SELECT t"},
+		{"after multi-byte", 10, "SELECT tàble", "SELECT tà"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			logger := zerolog.New(buf)
+			tr := NewTracer("test", &TraceParam{MaxSQLLength: tt.maxSQLLength})
+			tr.withSQL(logger.Info(), tt.sql, nil).Msg("")
+
+			entry := struct {
+				SQL         string `json:"sql"`
+				Fingerprint string `json:"fingerprint"`
+			}{}
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatal(err)
+			}
+
+			if entry.SQL != tt.want {
+				t.Errorf("sql = %q, want %q", entry.SQL, tt.want)
+			}
+			if !utf8.ValidString(entry.SQL) {
+				t.Errorf("sql = %q, want valid UTF-8", entry.SQL)
+			}
+			if entry.Fingerprint == "" {
+				t.Error("fingerprint is empty")
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package sqlpgx
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Skyrin/go-lib/e"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	ECode090E01 = e.Code090E + "01"
+	ECode090E02 = e.Code090E + "02"
+	ECode090E03 = e.Code090E + "03"
+	ECode090E04 = e.Code090E + "04"
+	ECode090E05 = e.Code090E + "05"
+	ECode090E06 = e.Code090E + "06"
+)
+
+// typeLoader loads the custom types (enums, composites) of a pool and registers them on
+// each new connection. The types are only loaded from the database by the first
+// connection, later connections reuse them.
+type typeLoader struct {
+	nameList []string
+	typeList []*pgtype.Type
+	mutex    sync.Mutex
+}
+
+// newTypeLoader initializes a new type loader for the type names
+func newTypeLoader(nameList []string) (tl *typeLoader) {
+	return &typeLoader{
+		nameList: nameList,
+	}
+}
+
+// register registers the types, and their array types, on the connection. Types must be
+// listed after any custom types they depend on, e.g. an enum used by a composite.
+func (tl *typeLoader) register(ctx context.Context, conn *pgx.Conn) (err error) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	if tl.typeList != nil {
+		for _, t := range tl.typeList {
+			conn.TypeMap().RegisterType(t)
+		}
+		return nil
+	}
+
+	typeList := make([]*pgtype.Type, 0, len(tl.nameList)*2)
+	for _, name := range tl.nameList {
+		for _, n := range []string{name, getArrayTypeName(name)} {
+			t, err := conn.LoadType(ctx, n)
+			if err != nil {
+				return e.W(err, ECode090E01, fmt.Sprintf("type: %s", n))
+			}
+
+			conn.TypeMap().RegisterType(t)
+			typeList = append(typeList, t)
+		}
+	}
+	tl.typeList = typeList
+
+	return nil
+}
+
+// getArrayTypeName returns the name of the array type of the type, which is the type
+// name prefixed with an underscore, keeping the schema if it is qualified
+func getArrayTypeName(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[:i+1] + "_" + name[i+1:]
+	}
+
+	return "_" + name
+}
+
+// Enum maps a Postgres enum type to a Go string type and its constants. Once the enum
+// is registered on the pool (see ConnParam.Types), values of the enum and enum array
+// columns can be scanned directly into T and []T and passed as bind parameters.
+//
+//	type ProcessStatus string
+//	const (
+//		ProcessStatusActive   = ProcessStatus("active")
+//		ProcessStatusInactive = ProcessStatus("inactive")
+//	)
+//	var ProcessStatusEnum = sqlpgx.NewEnum("t_process_status",
+//		ProcessStatusActive, ProcessStatusInactive)
+type Enum[T ~string] struct {
+	TypeName string // The Postgres type name, optionally schema qualified
+	Values   []T    // The Go constants, in the same order as the Postgres labels
+}
+
+// NewEnum initializes a new enum mapping
+func NewEnum[T ~string](typeName string, values ...T) (en *Enum[T]) {
+	return &Enum[T]{
+		TypeName: typeName,
+		Values:   values,
+	}
+}
+
+// IsValid returns whether the value is one of the enum constants
+func (en *Enum[T]) IsValid(v T) bool {
+	for _, ev := range en.Values {
+		if ev == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parse converts the string to the enum type, returning an error if it is not one of
+// the enum constants
+func (en *Enum[T]) Parse(s string) (v T, err error) {
+	v = T(s)
+	if !en.IsValid(v) {
+		return v, e.N(ECode090E02,
+			fmt.Sprintf("invalid value '%s' for enum '%s'", s, en.TypeName))
+	}
+
+	return v, nil
+}
+
+// Verify checks the enum constants match the labels of the Postgres enum type, so a
+// value added to or removed from either side is caught, e.g. on application start
+func (en *Enum[T]) Verify(ctx context.Context, db *Connection) (err error) {
+	rows, err := db.Query(ctx, `SELECT enumlabel FROM pg_enum
+		WHERE enumtypid=$1::regtype ORDER BY enumsortorder`, en.TypeName)
+	if err != nil {
+		return e.W(err, ECode090E03, en.TypeName)
+	}
+	defer rows.Close()
+
+	labelList := []string{}
+	for rows.Next() {
+		var label string
+		if err := rows.Scan(&label); err != nil {
+			return e.W(err, ECode090E04, en.TypeName)
+		}
+		labelList = append(labelList, label)
+	}
+
+	if err := rows.Err(); err != nil {
+		return e.W(err, ECode090E05, en.TypeName)
+	}
+
+	valueList := make([]string, len(en.Values))
+	for i, v := range en.Values {
+		valueList[i] = string(v)
+	}
+
+	if strings.Join(labelList, ",") != strings.Join(valueList, ",") {
+		return e.N(ECode090E06,
+			fmt.Sprintf("enum '%s' mismatch, db: [%s], go: [%s]", en.TypeName,
+				strings.Join(labelList, ","), strings.Join(valueList, ",")))
+	}
+
+	return nil
+}